@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	API_TIMEOUT time.Duration = 30 * time.Second
+	API_BACKOFF time.Duration = 500 * time.Millisecond
+)
+
+// Client of remote zfs_api and scst_api. Every call is bounded by the
+// context of incoming request and by per-call timeout
+type ApiClient struct {
+	api     *url.URL
+	client  *http.Client
+	timeout time.Duration
+	retries int
+	backoff time.Duration
+}
+
+func NewApiClient(api string, timeout time.Duration, retries int, backoff time.Duration) (*ApiClient, error) {
+	u, err := url.Parse(api)
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		timeout = API_TIMEOUT
+	}
+	if backoff <= 0 {
+		backoff = API_BACKOFF
+	}
+	return &ApiClient{
+		api:     u,
+		client:  &http.Client{},
+		timeout: timeout,
+		retries: retries,
+		backoff: backoff,
+	}, nil
+}
+
+func (c *ApiClient) url(command string, param map[string]string) string {
+	u := *c.api
+	q := u.Query()
+	q.Set("action", command)
+	for k := range param {
+		q.Set(k, param[k])
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func (c *ApiClient) get(ctx context.Context, apiUrl string) (res []byte, retry bool, err error) {
+	var (
+		request  *http.Request
+		response *http.Response
+	)
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	if request, err = http.NewRequestWithContext(ctx, http.MethodGet, apiUrl, nil); err != nil {
+		return
+	}
+	if response, err = c.client.Do(request); err != nil {
+		retry = true
+		return
+	}
+	defer response.Body.Close()
+	if res, err = ioutil.ReadAll(response.Body); err != nil {
+		retry = true
+	} else if response.StatusCode < 200 || response.StatusCode > 299 {
+		err = fmt.Errorf("%s returned %s", c.api.Host, response.Status)
+		retry = response.StatusCode >= 500
+	}
+	return
+}
+
+// Call api action and decode JSON response to res. Idempotent calls are
+// retried with exponential backoff on network errors and 5xx responses
+func (c *ApiClient) Call(ctx context.Context, command string, param map[string]string, idempotent bool, res interface{}) (err error) {
+	var (
+		apiResponse []byte
+		retry       bool
+		attempts    int           = 1
+		backoff     time.Duration = c.backoff
+	)
+	if idempotent {
+		attempts += c.retries
+	}
+	apiUrl := c.url(command, param)
+	for attempt := 1; ; attempt++ {
+		if apiResponse, retry, err = c.get(ctx, apiUrl); err == nil || !retry || attempt >= attempts {
+			break
+		}
+		log.Printf("%s: %s, retrying in %s", command, err.Error(), backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	if err = json.Unmarshal(apiResponse, res); err != nil {
+		err = fmt.Errorf("invalid %s response from %s: %s", command, c.api.Host, err.Error())
+		log.Println(err.Error())
+	}
+	return
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+const (
+	bookmarkCreate  string = "create"
+	bookmarkList    string = "list"
+	bookmarkDelete  string = "delete"
+	bookmarkReplace string = "replace"
+)
+
+// Full name of dataset member. Short names are taken as members of dataset
+func datasetMember(dataset string, name string, sep string) string {
+	if name == "" || strings.ContainsAny(name, "@#") {
+		return name
+	}
+	return dataset + sep + name
+}
+
+// Bookmark snapshot. In replace mode snapshot is destroyed after bookmark is
+// created so its space is freed while incremental sends from it are still
+// possible. Snapshot with dependent clones is not replaced
+func bookmarkSnapshot(ctx context.Context, zfs ZfsBackend, journal *stepJournal, snapshot string, bookmark string, replace bool) (err error) {
+	var (
+		clones []string
+	)
+	if replace {
+		if clones, err = zfs.GetClones(ctx, snapshot, false); err != nil {
+			return
+		}
+		if len(clones) > 0 {
+			return fmt.Errorf("%s has dependent clones: %s", snapshot, strings.Join(clones, ","))
+		}
+	}
+	ctx, cancel := stepsContext(ctx)
+	defer cancel()
+	if err = journal.do("bookmark "+snapshot+" "+bookmark,
+		func() error { return zfs.CreateBookmark(ctx, snapshot, bookmark) },
+		func() error { return zfs.DestroyBookmark(ctx, bookmark) }); err != nil || !replace {
+		return
+	}
+	// Bookmark is kept if snapshot is not destroyed, it is valid anyway
+	err = journal.do("destroy "+snapshot,
+		func() (err error) {
+			_, err = zfs.DestroyDataset(ctx, snapshot, ZfsDestroyOptions{})
+			return
+		},
+		nil)
+	return
+}
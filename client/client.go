@@ -0,0 +1,217 @@
+// Package client is a Go client of pk_api_go. It calls api actions and
+// decodes XML responses with pkapi types
+package client
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Tualua/pk_api_go/pkapi"
+)
+
+// Client of pk_api_go api
+type Client struct {
+	api    *url.URL
+	client *http.Client
+}
+
+// Result of smartclone and checkclone
+type SmartCloneResult struct {
+	Target       string
+	ActualClone  string
+	LastSnapshot string
+	Origin       string
+	Written      string
+	Plan         string
+	BlockedBy    []string
+	Steps        []pkapi.XmlStep
+}
+
+func New(api string, timeout time.Duration) (*Client, error) {
+	u, err := url.Parse(api)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{api: u, client: &http.Client{Timeout: timeout}}, nil
+}
+
+// Call action and decode XML response to res. Response with error status is
+// returned as error, res is filled anyway
+func (c *Client) Call(ctx context.Context, action string, param map[string]string, res interface{}) (err error) {
+	var (
+		request  *http.Request
+		response *http.Response
+		data     []byte
+		generic  pkapi.XmlResponseGeneric
+	)
+	u := *c.api
+	q := u.Query()
+	q.Set("action", action)
+	for k := range param {
+		q.Set(k, param[k])
+	}
+	u.RawQuery = q.Encode()
+	if request, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil); err != nil {
+		return
+	}
+	request.Header.Set("Accept", "application/xml")
+	if response, err = c.client.Do(request); err != nil {
+		return
+	}
+	defer response.Body.Close()
+	if data, err = ioutil.ReadAll(response.Body); err != nil {
+		return
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", c.api.Host, response.Status)
+	}
+	if err = xml.Unmarshal(data, &generic); err != nil {
+		return fmt.Errorf("invalid %s response: %s", action, err.Error())
+	}
+	if res != nil {
+		if err = xml.Unmarshal(data, res); err != nil {
+			return fmt.Errorf("invalid %s response: %s", action, err.Error())
+		}
+	}
+	if generic.Status == "error" {
+		err = errors.New(generic.Fields.Get("errormessage"))
+	}
+	return
+}
+
+func smartCloneResult(res *pkapi.XmlResponse) (SmartCloneResult, error) {
+	result := SmartCloneResult{
+		Target:       res.Fields.Get("target"),
+		ActualClone:  res.Fields.Get("actualclone"),
+		LastSnapshot: res.Fields.Get("lastsnapshot"),
+		Origin:       res.Fields.Get("origin"),
+		Written:      res.Fields.Get("written"),
+		Plan:         res.Fields.Get("plan"),
+	}
+	if blockedBy := res.Fields.Get("blockedby"); blockedBy != "" {
+		result.BlockedBy = strings.Split(blockedBy, ",")
+	}
+	if res.Log != nil {
+		return result, res.Log.DecodeEntries(&result.Steps)
+	}
+	return result, nil
+}
+
+func dryrunParam(param map[string]string, dryrun bool) map[string]string {
+	if dryrun {
+		param["dryrun"] = "1"
+	}
+	return param
+}
+
+// Reset clone to the last snapshot of clone source
+func (c *Client) SmartClone(ctx context.Context, clonesource string, clonename string, deviceid string, dryrun bool) (SmartCloneResult, error) {
+	var (
+		res pkapi.XmlResponse
+	)
+	err := c.Call(ctx, "smartclone", dryrunParam(map[string]string{
+		"clonesource": clonesource,
+		"clonename":   clonename,
+		"deviceid":    deviceid,
+	}, dryrun), &res)
+	result, decodeErr := smartCloneResult(&res)
+	if err == nil {
+		err = decodeErr
+	}
+	return result, err
+}
+
+// Reset desktop and games disks of a seat. Disks report their status on their own
+func (c *Client) SmartClone2(ctx context.Context, systemmaster string, gamesmaster string, systemid string, gamesid string, dryrun bool) (*pkapi.XmlResponseSC2, error) {
+	var (
+		res pkapi.XmlResponseSC2
+	)
+	err := c.Call(ctx, "smartclone2", dryrunParam(map[string]string{
+		"systemmaster": systemmaster,
+		"gamesmaster":  gamesmaster,
+		"systemid":     systemid,
+		"gamesid":      gamesid,
+	}, dryrun), &res)
+	return &res, err
+}
+
+// Check if clone is on the last snapshot of clone source. With dryrun the
+// plan of smartclone is returned, deviceid is optional
+func (c *Client) CheckClone(ctx context.Context, clonesource string, clonename string, deviceid string, dryrun bool) (SmartCloneResult, error) {
+	var (
+		res pkapi.XmlResponse
+	)
+	param := map[string]string{
+		"clonesource": clonesource,
+		"clonename":   clonename,
+	}
+	if deviceid != "" {
+		param["deviceid"] = deviceid
+	}
+	err := c.Call(ctx, "checkclone", dryrunParam(param, dryrun), &res)
+	result, decodeErr := smartCloneResult(&res)
+	if err == nil {
+		err = decodeErr
+	}
+	return result, err
+}
+
+// List all datasets, snapshots and bookmarks
+func (c *Client) Status(ctx context.Context) (res []pkapi.ZfsEntity, err error) {
+	var (
+		response pkapi.XmlResponse
+	)
+	if err = c.Call(ctx, "status", nil, &response); err == nil && response.Log != nil {
+		err = response.Log.DecodeEntries(&res)
+	}
+	return
+}
+
+// Last snapshot of dataset with its metadata
+type LastSnapshotResult struct {
+	LastSnapshot string
+	Creation     string
+	Used         string
+	Referenced   string
+	Clones       string
+}
+
+func (c *Client) LastSnapshot(ctx context.Context, dataset string) (res LastSnapshotResult, err error) {
+	var (
+		response pkapi.XmlResponse
+	)
+	if err = c.Call(ctx, "lastsnapshot", map[string]string{"dataset": dataset}, &response); err == nil {
+		res = LastSnapshotResult{
+			LastSnapshot: response.Fields.Get("lastsnapshot"),
+			Creation:     response.Fields.Get("creation"),
+			Used:         response.Fields.Get("used"),
+			Referenced:   response.Fields.Get("referenced"),
+			Clones:       response.Fields.Get("clones"),
+		}
+	}
+	return
+}
+
+// Make node receive send stream from peer url into dataset. Received
+// snapshot is returned. Failed resumable receive returns resume token
+func (c *Client) StartReceiving(ctx context.Context, dataset string, peerUrl string, resumable bool) (snapshot string, token string, err error) {
+	var (
+		response pkapi.XmlResponse
+	)
+	param := map[string]string{
+		"dataset": dataset,
+		"url":     peerUrl,
+	}
+	if resumable {
+		param["resumable"] = "1"
+	}
+	err = c.Call(ctx, "startreceiving", param, &response)
+	return response.Fields.Get("snapshot"), response.Fields.Get("resumetoken"), err
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// Properties which can be set on new clone with clone action
+var cloneSettableProperties = []string{"volblocksize", "compression", "refreservation"}
+
+// Create new clone of clone source with @0 baseline snapshot. Clone is made
+// from the given snapshot or from the last snapshot of clone source. Origin
+// of created clone is returned, it is empty when it could not be read
+func newClone(ctx context.Context, zfs ZfsBackend, journal *stepJournal, clonename string, clonesource string, snapshot string, props map[string]string) (origin string, err error) {
+	var (
+		exists bool
+	)
+	if exists, err = zfs.CheckDatasetExists(ctx, clonename); err != nil {
+		return
+	} else if exists {
+		return "", fmt.Errorf("%s already exists", clonename)
+	}
+	ctx, cancel := stepsContext(ctx)
+	defer cancel()
+	zeroSnapshot := clonename + "@0"
+	if snapshot != "" {
+		err = journal.do("clone "+snapshot+" "+clonename,
+			func() error { return zfs.Clone(ctx, snapshot, clonename, props) },
+			func() error { return zfs.Destroy(ctx, clonename) })
+	} else {
+		err = journal.do("clone "+clonesource+" "+clonename,
+			func() error { return zfs.CloneLast(ctx, clonename, clonesource, props) },
+			func() error { return zfs.Destroy(ctx, clonename) })
+	}
+	if err == nil {
+		err = journal.do("snapshot "+zeroSnapshot,
+			func() error { return zfs.CreateSnapshot(ctx, clonename, "0") },
+			func() error { return zfs.Destroy(ctx, zeroSnapshot) })
+	}
+	if err != nil {
+		journal.rollback()
+		return
+	}
+	// Clone is already created, failed read does not fail the action
+	if cloneinfo, infoErr := zfs.GetCloneInfo(ctx, clonename); infoErr != nil {
+		log.Println(infoErr.Error())
+	} else {
+		origin = cloneinfo["origin"]
+	}
+	return
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"time"
 
 	"github.com/go-yaml/yaml"
 )
@@ -10,11 +11,47 @@ type Config struct {
 	Server struct {
 		Port string `yaml:"port"`
 		Host string `yaml:"host"`
+		Url  string `yaml:"url"`
 	} `yaml:"server"`
 	Apis struct {
-		ScstApi string `yaml:"scst_api"`
-		ZfsApi  string `yaml:"zfs_api"`
+		ScstApi string        `yaml:"scst_api"`
+		ZfsApi  string        `yaml:"zfs_api"`
+		Timeout time.Duration `yaml:"timeout"`
+		Retries int           `yaml:"retries"`
+		Backoff time.Duration `yaml:"backoff"`
+
+		StepsTimeout time.Duration `yaml:"steps_timeout"`
 	} `yaml:"apis"`
+	Zfs struct {
+		Backend   string   `yaml:"backend"`
+		Binary    string   `yaml:"binary"`
+		Protected []string `yaml:"protected"`
+
+		ClonePrefixes `yaml:",inline"`
+	} `yaml:"zfs"`
+	Scst struct {
+		Backend   string `yaml:"backend"`
+		SysfsRoot string `yaml:"sysfs_root"`
+		IqnPrefix string `yaml:"iqn_prefix"`
+	} `yaml:"scst"`
+	Mount struct {
+		Root string `yaml:"root"`
+	} `yaml:"mount"`
+	Peers []Peer `yaml:"peers"`
+	Seats []Seat `yaml:"seats"`
+}
+
+// Parent datasets of seat disks, dataset of disk is prefix followed by its
+// device id
+type ClonePrefixes struct {
+	System string `yaml:"system_prefix"`
+	Games  string `yaml:"games_prefix"`
+}
+
+// Storage node running the same api, datasets are replicated to it
+type Peer struct {
+	Name string `yaml:"name"`
+	Url  string `yaml:"url"`
 }
 
 func NewConfig(configPath string) (*Config, error) {
@@ -31,3 +68,12 @@ func NewConfig(configPath string) (*Config, error) {
 
 	return config, nil
 }
+
+// Seat served by this node. Id is device id of desktop disk, disks are reset
+// from masters by release
+type Seat struct {
+	Id           string `yaml:"id"`
+	GamesId      string `yaml:"gamesid"`
+	SystemMaster string `yaml:"systemmaster"`
+	GamesMaster  string `yaml:"gamesmaster"`
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Check if dataset matches one of protected patterns from config
+func protectedDataset(protected []string, dataset string) bool {
+	for _, pattern := range protected {
+		if matched, err := path.Match(pattern, dataset); (err == nil && matched) || pattern == dataset {
+			return true
+		}
+	}
+	return false
+}
+
+// Refuse to destroy protected masters, datasets with dependent clones and
+// datasets behind SCST device with active iSCSI sessions. With recursive
+// destroy children of dataset are checked too
+func checkDestroy(ctx context.Context, zfs ZfsBackend, scst ScstBackend, protected []string, dataset string, deviceid string, recursive bool) (err error) {
+	var (
+		entities []ZfsEntity
+		clones   []string
+	)
+	if protectedDataset(protected, dataset) {
+		return fmt.Errorf("%s is protected", dataset)
+	}
+	if recursive && !strings.Contains(dataset, "@") {
+		if entities, err = zfs.ListAll(ctx); err != nil {
+			return
+		}
+		for _, entity := range entities {
+			if strings.HasPrefix(entity.Name, dataset+"/") && protectedDataset(protected, entity.Name) {
+				return fmt.Errorf("%s is protected", entity.Name)
+			}
+		}
+	}
+	if clones, err = zfs.GetClones(ctx, dataset, recursive); err != nil {
+		return
+	}
+	if len(clones) > 0 {
+		return fmt.Errorf("%s has dependent clones: %s", dataset, strings.Join(clones, ","))
+	}
+	if deviceid != "" {
+		err = ScstCheckIscsiSessions(ctx, scst, deviceid)
+	} else if !strings.Contains(dataset, "@") {
+		err = checkDatasetDevices(ctx, zfs, scst, "destroy", dataset, entities, recursive)
+	}
+	return
+}
+
+// Check iSCSI sessions of SCST devices backed by zvol of dataset or, with
+// recursive, by zvols of its children listed in entities. When devices can
+// not be looked up action on volumes is refused as it is unknown whether
+// they are in use
+func checkDatasetDevices(ctx context.Context, zfs ZfsBackend, scst ScstBackend, action string, dataset string, entities []ZfsEntity, recursive bool) (err error) {
+	var (
+		devices  []string
+		datasets []string = []string{dataset}
+		props    map[string]string
+	)
+	if devices, err = scst.DevicesByFile(ctx, zvolDevice(dataset), recursive); err == nil {
+		for _, device := range devices {
+			if err = ScstCheckIscsiSessions(ctx, scst, device); err != nil {
+				return
+			}
+		}
+		return
+	}
+	if !errors.Is(err, errNotSupported) {
+		return
+	}
+	for _, entity := range entities {
+		if strings.HasPrefix(entity.Name, dataset+"/") && !strings.ContainsAny(entity.Name, "@#") {
+			datasets = append(datasets, entity.Name)
+		}
+	}
+	for _, name := range datasets {
+		if props, err = zfs.GetProperties(ctx, name, []string{"type"}); err != nil {
+			return
+		}
+		if props["type"] == "volume" {
+			return fmt.Errorf("deviceid is required to %s volume %s", action, name)
+		}
+	}
+	return
+}
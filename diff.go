@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// Number of diff entries returned at once unless limit is given
+const DIFF_PAGE_LIMIT int = 1000
+
+type XmlDiffEntry struct {
+	XMLName xml.Name `xml:"change" json:"-"`
+	Type    string   `xml:"type" json:"type"`
+	Path    string   `xml:"path" json:"path"`
+	NewPath string   `xml:"newpath,omitempty" json:"newpath,omitempty"`
+}
+
+var diffTypes = map[string]string{
+	"+": "added",
+	"-": "removed",
+	"M": "modified",
+	"R": "renamed",
+}
+
+// Parse fields of zfs diff -H line: change mark, path and new path of
+// renamed file
+func parseDiffLine(fields []string) (res XmlDiffEntry, err error) {
+	var (
+		ok bool
+	)
+	if len(fields) < 2 {
+		return res, fmt.Errorf("unexpected zfs diff output: %s", strings.Join(fields, " "))
+	}
+	if res.Type, ok = diffTypes[fields[0]]; !ok {
+		return res, fmt.Errorf("unknown zfs diff change: %s", fields[0])
+	}
+	res.Path = fields[1]
+	if res.Type == "renamed" {
+		if len(fields) != 3 {
+			return res, fmt.Errorf("unexpected zfs diff output: %s", strings.Join(fields, " "))
+		}
+		res.NewPath = fields[2]
+	}
+	return
+}
+
+// Page of diff lines starting at offset and whether there are more lines
+// after it
+func diffPage(lines []string, offset int, limit int) ([]string, bool) {
+	if offset >= len(lines) {
+		return nil, false
+	}
+	if end := offset + limit; end < len(lines) {
+		return lines[offset:end], true
+	}
+	return lines[offset:], false
+}
+
+// zfs diff compares files so it works on filesystems only, zvols of seat
+// disks can not be compared with it
+func checkDiffDataset(ctx context.Context, zfs ZfsBackend, snapshot string) (err error) {
+	var (
+		props map[string]string
+	)
+	dataset := strings.SplitN(snapshot, "@", 2)[0]
+	if props, err = zfs.GetProperties(ctx, dataset, []string{"type"}); err != nil {
+		return
+	}
+	if props["type"] == "volume" {
+		err = fmt.Errorf("zfs diff works on filesystems only, %s is a volume", dataset)
+	}
+	return
+}
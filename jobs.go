@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	jobSend    string = "send"
+	jobReceive string = "receive"
+)
+
+const (
+	jobRunning   string = "running"
+	jobDone      string = "done"
+	jobFailed    string = "failed"
+	jobCancelled string = "cancelled"
+)
+
+// Number of finished jobs kept for lists and logs
+const JOBS_KEEP_FINISHED int = 100
+
+type XmlJob struct {
+	XMLName     xml.Name `xml:"job" json:"-"`
+	Id          string   `xml:"id" json:"id"`
+	Kind        string   `xml:"kind" json:"kind"`
+	Source      string   `xml:"source" json:"source"`
+	Destination string   `xml:"destination" json:"destination"`
+	State       string   `xml:"state" json:"state"`
+	Bytes       string   `xml:"bytes" json:"bytes"`
+	Total       string   `xml:"total,omitempty" json:"total,omitempty"`
+	Rate        string   `xml:"rate" json:"rate"`
+	Eta         string   `xml:"eta,omitempty" json:"eta,omitempty"`
+	Started     string   `xml:"started" json:"started"`
+	Finished    string   `xml:"finished,omitempty" json:"finished,omitempty"`
+	Error       string   `xml:"error,omitempty" json:"error,omitempty"`
+}
+
+type XmlJobLogLine struct {
+	XMLName xml.Name `xml:"line" json:"-"`
+	Time    string   `xml:"time" json:"time"`
+	Message string   `xml:"message" json:"message"`
+}
+
+// Send or receive operation tracked in background. Bytes are counted by
+// stream wrapped with Reader or Writer
+type Job struct {
+	// Counters go first to be aligned for atomic operations
+	bytes       int64
+	total       int64
+	id          string
+	kind        string
+	source      string
+	destination string
+	started     time.Time
+	cancel      context.CancelFunc
+
+	mu       sync.Mutex
+	state    string
+	finished time.Time
+	err      string
+	log      []XmlJobLogLine
+}
+
+type JobManager struct {
+	mu   sync.Mutex
+	seq  int
+	jobs map[string]*Job
+}
+
+func NewJobManager() *JobManager {
+	return &JobManager{jobs: make(map[string]*Job)}
+}
+
+// Start tracking job. Returned context is cancelled when job is cancelled
+func (m *JobManager) Start(ctx context.Context, kind string, source string, destination string) (*Job, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seq++
+	job := &Job{
+		id:          kind + "-" + strconv.Itoa(m.seq),
+		kind:        kind,
+		source:      source,
+		destination: destination,
+		started:     time.Now(),
+		cancel:      cancel,
+		state:       jobRunning,
+	}
+	m.jobs[job.id] = job
+	m.prune()
+	job.Logf("started %s %s to %s", kind, source, destination)
+	return job, ctx
+}
+
+// Forget the oldest finished jobs above JOBS_KEEP_FINISHED
+func (m *JobManager) prune() {
+	var (
+		finished []*Job
+	)
+	for _, job := range m.jobs {
+		if job.State() != jobRunning {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= JOBS_KEEP_FINISHED {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].started.Before(finished[j].started) })
+	for _, job := range finished[:len(finished)-JOBS_KEEP_FINISHED] {
+		delete(m.jobs, job.id)
+	}
+}
+
+func (m *JobManager) Get(id string) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if job, ok := m.jobs[id]; ok {
+		return job, nil
+	}
+	return nil, fmt.Errorf("there is no job %s", id)
+}
+
+// Jobs of kind in order they were started
+func (m *JobManager) List(kind string) []*Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]*Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		if job.kind == kind {
+			res = append(res, job)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].started.Before(res[j].started) })
+	return res
+}
+
+func (m *JobManager) Cancel(id string) (err error) {
+	var (
+		job *Job
+	)
+	if job, err = m.Get(id); err == nil {
+		if job.State() != jobRunning {
+			err = fmt.Errorf("job %s is already %s", id, job.State())
+		} else {
+			job.Logf("cancel requested")
+			job.cancel()
+		}
+	}
+	return
+}
+
+func (j *Job) Id() string {
+	return j.id
+}
+
+func (j *Job) State() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.state
+}
+
+// Expected size of stream in bytes, it is used to estimate time left
+func (j *Job) SetTotal(total int64) {
+	atomic.StoreInt64(&j.total, total)
+}
+
+func (j *Job) Logf(format string, a ...interface{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.log = append(j.log, XmlJobLogLine{
+		Time:    time.Now().Format(time.RFC3339),
+		Message: fmt.Sprintf(format, a...),
+	})
+}
+
+func (j *Job) Log() []XmlJobLogLine {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]XmlJobLogLine(nil), j.log...)
+}
+
+// Finish job with result of operation. Job with cancelled context is
+// reported as cancelled whatever error the operation returned
+func (j *Job) Finish(ctx context.Context, err error) {
+	j.mu.Lock()
+	j.finished = time.Now()
+	switch {
+	case err == nil:
+		j.state = jobDone
+	case ctx.Err() != nil:
+		j.state = jobCancelled
+		j.err = err.Error()
+	default:
+		j.state = jobFailed
+		j.err = err.Error()
+	}
+	state := j.state
+	j.mu.Unlock()
+	j.cancel()
+	if err != nil {
+		j.Logf("%s: %s", state, err.Error())
+	} else {
+		j.Logf("%s, %d bytes", state, atomic.LoadInt64(&j.bytes))
+	}
+}
+
+func (j *Job) Info() XmlJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	bytes := atomic.LoadInt64(&j.bytes)
+	total := atomic.LoadInt64(&j.total)
+	res := XmlJob{
+		Id:          j.id,
+		Kind:        j.kind,
+		Source:      j.source,
+		Destination: j.destination,
+		State:       j.state,
+		Bytes:       strconv.FormatInt(bytes, 10),
+		Started:     j.started.Format(time.RFC3339),
+		Error:       j.err,
+	}
+	end := time.Now()
+	if !j.finished.IsZero() {
+		end = j.finished
+		res.Finished = j.finished.Format(time.RFC3339)
+	}
+	// Rate is in bytes per second, ETA is in seconds
+	rate := int64(0)
+	if elapsed := end.Sub(j.started).Seconds(); elapsed > 0 {
+		rate = int64(float64(bytes) / elapsed)
+	}
+	res.Rate = strconv.FormatInt(rate, 10)
+	if total > 0 {
+		res.Total = strconv.FormatInt(total, 10)
+		if j.state == jobRunning && rate > 0 && total > bytes {
+			res.Eta = strconv.FormatInt((total-bytes)/rate, 10)
+		}
+	}
+	return res
+}
+
+func (j *Job) Reader(r io.Reader) io.Reader {
+	return &jobReader{job: j, r: r}
+}
+
+func (j *Job) Writer(w io.Writer) io.Writer {
+	return &jobWriter{job: j, w: w}
+}
+
+type jobReader struct {
+	job *Job
+	r   io.Reader
+}
+
+func (c *jobReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	atomic.AddInt64(&c.job.bytes, int64(n))
+	return
+}
+
+type jobWriter struct {
+	job *Job
+	w   io.Writer
+}
+
+func (c *jobWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	atomic.AddInt64(&c.job.bytes, int64(n))
+	return
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Upper bound of time to wait for busy locks
+const LOCK_WAIT_MAX time.Duration = 5 * time.Minute
+
+type XmlLock struct {
+	XMLName xml.Name `xml:"lock" json:"-"`
+	Key     string   `xml:"key" json:"key"`
+	Request string   `xml:"request" json:"request"`
+	Action  string   `xml:"action" json:"action"`
+	Since   string   `xml:"since" json:"since"`
+	Held    bool     `xml:"held,omitempty" json:"held,omitempty"`
+}
+
+type lockEntry struct {
+	holder   XmlLock
+	keys     []string
+	released chan struct{}
+}
+
+// Locks datasets and SCST devices for the time of modifying operations so
+// concurrent requests can not work on the same seat. Locks of operations
+// leaving seat in intermediate state, like targetmount, are held after
+// request ends until the operation is undone
+type LockManager struct {
+	mu    sync.Mutex
+	locks map[string]*lockEntry
+}
+
+func NewLockManager() *LockManager {
+	return &LockManager{locks: make(map[string]*lockEntry)}
+}
+
+func datasetLock(dataset string) string {
+	return "dataset:" + dataset
+}
+
+func deviceLock(devid string) string {
+	return "device:" + devid
+}
+
+// Acquire all keys at once. If any of keys is held by another request, waits
+// until it is released but not longer than wait and only while ctx is not
+// cancelled. Zero wait fails immediately
+func (m *LockManager) Acquire(ctx context.Context, keys []string, request string, action string, wait time.Duration) (release func(), err error) {
+	return m.acquire(ctx, keys, request, action, wait, false)
+}
+
+// Acquire keys taking over locks held by the same action, e.g. unmount
+// takes over locks held since mount
+func (m *LockManager) Reclaim(ctx context.Context, keys []string, request string, action string, wait time.Duration) (release func(), err error) {
+	return m.acquire(ctx, keys, request, action, wait, true)
+}
+
+func (m *LockManager) acquire(ctx context.Context, keys []string, request string, action string, wait time.Duration, reclaim bool) (release func(), err error) {
+	var (
+		deadline time.Time = time.Now().Add(wait)
+		busy     *lockEntry
+		held     []*lockEntry
+	)
+	for {
+		m.mu.Lock()
+		busy, held = nil, nil
+		for _, key := range keys {
+			if entry, ok := m.locks[key]; ok {
+				if reclaim && entry.holder.Held && entry.holder.Action == action {
+					held = append(held, entry)
+					continue
+				}
+				busy = entry
+				break
+			}
+		}
+		if busy == nil {
+			// Taken over locks are dropped with all their keys
+			for _, entry := range held {
+				m.drop(entry)
+			}
+			entry := &lockEntry{
+				holder: XmlLock{
+					Request: request,
+					Action:  action,
+					Since:   time.Now().Format(time.RFC3339),
+				},
+				keys:     keys,
+				released: make(chan struct{}),
+			}
+			for _, key := range keys {
+				m.locks[key] = entry
+			}
+			m.mu.Unlock()
+			release = func() { m.release(entry) }
+			return
+		}
+		m.mu.Unlock()
+
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			if busy.holder.Held {
+				err = fmt.Errorf("busy: held by %s since %s", busy.holder.Action, busy.holder.Since)
+			} else {
+				err = fmt.Errorf("busy: %s since %s by request %s", busy.holder.Action, busy.holder.Since, busy.holder.Request)
+			}
+			return
+		}
+		timer := time.NewTimer(timeout)
+		select {
+		case <-busy.released:
+			timer.Stop()
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Keep keys locked by action after request ends. Keys are released when
+// they are reclaimed by the same action
+func (m *LockManager) Hold(keys []string, request string, action string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry := &lockEntry{
+		holder: XmlLock{
+			Request: request,
+			Action:  action,
+			Since:   time.Now().Format(time.RFC3339),
+			Held:    true,
+		},
+		keys:     keys,
+		released: make(chan struct{}),
+	}
+	for _, key := range keys {
+		if current, ok := m.locks[key]; ok && current.holder.Held {
+			m.drop(current)
+		}
+		m.locks[key] = entry
+	}
+}
+
+// Keys of lock held by action which includes key, empty when there is none
+func (m *LockManager) HeldKeys(key string, action string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if entry, ok := m.locks[key]; ok && entry.holder.Held && entry.holder.Action == action {
+		return append([]string(nil), entry.keys...)
+	}
+	return nil
+}
+
+func (m *LockManager) release(entry *lockEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.drop(entry)
+}
+
+// Remove keys of entry which still belong to it and wake up waiters, called
+// with mu locked
+func (m *LockManager) drop(entry *lockEntry) {
+	for _, key := range entry.keys {
+		if m.locks[key] == entry {
+			delete(m.locks, key)
+		}
+	}
+	select {
+	case <-entry.released:
+	default:
+		close(entry.released)
+	}
+}
+
+func (m *LockManager) List() []XmlLock {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]XmlLock, 0, len(m.locks))
+	for key, entry := range m.locks {
+		lock := entry.holder
+		lock.Key = key
+		res = append(res, lock)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Key < res[j].Key })
+	return res
+}
+
+// Request id is taken from X-Request-Id header or generated. Generated id is
+// stored in the header so the request keeps it
+func requestId(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	id := hex.EncodeToString(buf)
+	r.Header.Set("X-Request-Id", id)
+	return id
+}
+
+// Time to wait for busy locks in seconds, taken from wait query parameter.
+// It is limited by LOCK_WAIT_MAX
+func lockWait(r *http.Request) (wait time.Duration, err error) {
+	if wait, err = querySeconds(r, "wait"); err == nil && wait > LOCK_WAIT_MAX {
+		err = fmt.Errorf("invalid wait value: %s, maximum is %d", r.URL.Query().Get("wait"), int(LOCK_WAIT_MAX.Seconds()))
+	}
+	return
+}
+
+// Acquire locks for request using its id and wait parameter
+func lockRequest(locks *LockManager, r *http.Request, action string, keys ...string) (release func(), err error) {
+	var wait time.Duration
+	if wait, err = lockWait(r); err == nil {
+		release, err = locks.Acquire(r.Context(), keys, requestId(r), action, wait)
+	}
+	return
+}
+
+// Acquire locks for request taking over locks held by the same action
+func reclaimRequest(locks *LockManager, r *http.Request, action string, keys ...string) (release func(), err error) {
+	var wait time.Duration
+	if wait, err = lockWait(r); err == nil {
+		release, err = locks.Reclaim(r.Context(), keys, requestId(r), action, wait)
+	}
+	return
+}
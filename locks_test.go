@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Keys and holders of locks as they are listed
+func lockKeys(m *LockManager) (res []string) {
+	for _, lock := range m.List() {
+		res = append(res, lock.Key+" "+lock.Request)
+	}
+	return
+}
+
+func TestLockManagerAcquire(t *testing.T) {
+	keys := []string{datasetLock("data/kvm/desktop/1"), deviceLock("1")}
+	tests := []struct {
+		name      string
+		prepare   func(t *testing.T, m *LockManager)
+		reclaim   bool
+		wait      time.Duration
+		cancelled bool
+		wantErr   string
+		wantKeys  []string
+	}{
+		{
+			name:     "free",
+			wantKeys: []string{"dataset:data/kvm/desktop/1 r2", "device:1 r2"},
+		},
+		{
+			name: "busy without wait",
+			prepare: func(t *testing.T, m *LockManager) {
+				if _, err := m.Acquire(context.Background(), keys[1:], "r1", "smartclone", 0); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr:  "busy: smartclone",
+			wantKeys: []string{"device:1 r1"},
+		},
+		{
+			name: "waits until released",
+			prepare: func(t *testing.T, m *LockManager) {
+				release, err := m.Acquire(context.Background(), keys[:1], "r1", "smartclone", 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				time.AfterFunc(50*time.Millisecond, release)
+			},
+			wait:     5 * time.Second,
+			wantKeys: []string{"dataset:data/kvm/desktop/1 r2", "device:1 r2"},
+		},
+		{
+			name: "deadline",
+			prepare: func(t *testing.T, m *LockManager) {
+				if _, err := m.Acquire(context.Background(), keys, "r1", "smartclone", 0); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wait:     50 * time.Millisecond,
+			wantErr:  "busy: smartclone",
+			wantKeys: []string{"dataset:data/kvm/desktop/1 r1", "device:1 r1"},
+		},
+		{
+			name: "cancelled request",
+			prepare: func(t *testing.T, m *LockManager) {
+				if _, err := m.Acquire(context.Background(), keys, "r1", "smartclone", 0); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wait:      5 * time.Second,
+			cancelled: true,
+			wantErr:   context.Canceled.Error(),
+			wantKeys:  []string{"dataset:data/kvm/desktop/1 r1", "device:1 r1"},
+		},
+		{
+			name: "held after request",
+			prepare: func(t *testing.T, m *LockManager) {
+				release, err := m.Acquire(context.Background(), keys, "r1", "targetmount", 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				m.Hold(keys, "r1", "targetmount")
+				release()
+			},
+			wantErr:  "busy: held by targetmount",
+			wantKeys: []string{"dataset:data/kvm/desktop/1 r1", "device:1 r1"},
+		},
+		{
+			name: "reclaim drops all keys of held lock",
+			prepare: func(t *testing.T, m *LockManager) {
+				m.Hold(append(keys, deviceLock("101")), "r1", "targetmount")
+			},
+			reclaim:  true,
+			wantKeys: []string{"dataset:data/kvm/desktop/1 r2", "device:1 r2"},
+		},
+		{
+			name: "reclaim of lock held by another action",
+			prepare: func(t *testing.T, m *LockManager) {
+				m.Hold(keys, "r1", "release")
+			},
+			reclaim:  true,
+			wantErr:  "busy: held by release",
+			wantKeys: []string{"dataset:data/kvm/desktop/1 r1", "device:1 r1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				release func()
+				err     error
+			)
+			m := NewLockManager()
+			if tt.prepare != nil {
+				tt.prepare(t, m)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancelled {
+				time.AfterFunc(50*time.Millisecond, cancel)
+			}
+			if tt.reclaim {
+				release, err = m.Reclaim(ctx, keys, "r2", "targetmount", tt.wait)
+			} else {
+				release, err = m.Acquire(ctx, keys, "r2", "targetmount", tt.wait)
+			}
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+			if got := lockKeys(m); strings.Join(got, ",") != strings.Join(tt.wantKeys, ",") {
+				t.Errorf("locks = %v, want %v", got, tt.wantKeys)
+			}
+			if release != nil {
+				release()
+				if got := m.List(); len(got) != 0 {
+					t.Errorf("locks after release = %v", got)
+				}
+			}
+		})
+	}
+}
+
+func TestLockManagerHeldKeys(t *testing.T) {
+	m := NewLockManager()
+	keys := []string{datasetLock("data/kvm/desktop/1"), deviceLock("1")}
+	m.Hold(keys, "r1", "targetmount")
+	if got := m.HeldKeys(deviceLock("1"), "targetmount"); strings.Join(got, ",") != strings.Join(keys, ",") {
+		t.Errorf("held keys = %v, want %v", got, keys)
+	}
+	if got := m.HeldKeys(deviceLock("1"), "release"); got != nil {
+		t.Errorf("held keys of another action = %v", got)
+	}
+	if got := m.HeldKeys(deviceLock("2"), "targetmount"); got != nil {
+		t.Errorf("held keys of free key = %v", got)
+	}
+}
@@ -1,142 +1,160 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
+	"github.com/Tualua/pk_api_go/pkapi"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 )
 
 // const tmpPath string = "/tmp"
 
-type SmartCloneInfo struct {
-	origin       string
-	written      string
-	lastsnapshot string
-	actualclone  string
-}
+// Default parent dataset of seat disks. Games disks live next to desktop
+// disks unless games_prefix is configured
+const SEAT_CLONE_PREFIX string = "data/kvm/desktop/"
 
 func loggingMiddleware(next http.Handler) http.Handler {
 	return handlers.CombinedLoggingHandler(os.Stdout, next)
 }
 
-func smartClone(apiZfs string, apiScst string, clonename string, clonesource string, deviceid string) (res SmartCloneInfo, err error) {
-	var (
-		lastSnapshot   string
-		cloneinfo      map[string]string = make(map[string]string)
-		zeroSnapExists bool
-	)
-	if lastSnapshot, err = ZfsGetLastSnapshot(apiZfs, clonesource); err != nil {
-		fmt.Println(err.Error())
-	} else {
-		if lastSnapshot == "" {
-			err = fmt.Errorf("there is no any snapshot in %s", clonesource)
-		} else {
-			res.lastsnapshot = lastSnapshot
-			if cloneinfo, err = ZfsGetCloneInfo(apiZfs, clonename); err != nil {
-				fmt.Println(err.Error())
-			} else {
-				// Check if dataset is clone
-				if cloneinfo["origin"] == "" {
-					err = fmt.Errorf("%s is not clone", clonename)
-				} else {
-					res.origin = cloneinfo["origin"]
-					res.written = cloneinfo["written"]
-					// Check if clone is modified or is not on last snapshot
-					if cloneinfo["written"] != "0" || cloneinfo["origin"] != lastSnapshot {
-						// Check if there are any established iSCSI session
-						if err = ScstCheckIscsiSessions(apiScst, deviceid); err != nil {
-							fmt.Println(err.Error())
-						} else {
-							// Deactivate device to make it avaliable for modifications
-							if err = ScstDeactivateDevice(apiScst, deviceid); err != nil {
-								fmt.Println(err.Error())
-							} else {
-								zeroSnapshot := clonename + "@0"
-								if zeroSnapExists, err = ZfsCheckDatasetExists(apiZfs, zeroSnapshot); err != nil {
-									fmt.Println(err.Error())
-								} else {
-									if cloneinfo["origin"] == lastSnapshot && zeroSnapExists {
-										ZfsRollback(apiZfs, zeroSnapshot)
-									} else {
-										ZfsDestroy(apiZfs, clonename)
-										ZfsCloneLast(apiZfs, clonename, clonesource)
-										ZfsCreateSnapshot(apiZfs, clonename, "0")
-									}
-									if err = ScstActivateDevice(apiScst, deviceid); err != nil {
-										fmt.Println(err.Error())
-									}
-								}
-							}
-
-						}
-					} else {
-						res.actualclone = "nothing to do"
-					}
-				}
-			}
-		}
-	}
-	return
-}
-
 func run(cfg *Config) {
+	zfs, err := NewZfsBackend(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	scst, err := NewScstBackend(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 	router := mux.NewRouter().StrictSlash(true)
 	addrString := cfg.Server.Host + ":" + cfg.Server.Port
+	locks := NewLockManager()
+	jobs := NewJobManager()
+	iqnPrefix := cfg.Scst.IqnPrefix
+	if iqnPrefix == "" {
+		iqnPrefix = SCST_IQN_PREFIX
+	}
+	seats := NewSeatInventory(cfg.Seats)
+	prefixes := cfg.Zfs.ClonePrefixes
+	if prefixes.System == "" {
+		prefixes.System = SEAT_CLONE_PREFIX
+	}
+	if prefixes.Games == "" {
+		prefixes.Games = SEAT_CLONE_PREFIX
+	}
+	if cfg.Apis.StepsTimeout > 0 {
+		stepsTimeout = cfg.Apis.StepsTimeout
+	}
+	mountRoot := cfg.Mount.Root
+	if mountRoot == "" {
+		mountRoot = MOUNT_ROOT
+	}
+	if err = holdMountLocks(locks, mountRoot); err != nil {
+		log.Println(err.Error())
+	}
 	router.Path("/").Queries("action", "snapshot",
 		"snapsource", "{snapsource}",
-		"snapname", "{snapname}").HandlerFunc(apiSnapshot(cfg.Apis.ZfsApi))
-	router.Path("/").Queries("action", "bookmark").HandlerFunc(apiBookmark)
-	router.Path("/").Queries("action", "clone").HandlerFunc(apiClone)
-	router.Path("/").Queries("action", "destroy").HandlerFunc(apiDestroy)
-	router.Path("/").Queries("action", "status").HandlerFunc(apiStatus(cfg.Apis.ZfsApi))
+		"snapname", "{snapname}").HandlerFunc(apiSnapshot(zfs))
+	router.Path("/").Queries("action", "bookmark",
+		"dataset", "{dataset}",
+	).HandlerFunc(apiBookmark(zfs, locks))
+	router.Path("/").Queries("action", "clone",
+		"clonesource", "{clonesource}",
+		"clonename", "{clonename}",
+	).HandlerFunc(apiClone(zfs, locks))
+	router.Path("/").Queries("action", "destroy",
+		"dataset", "{dataset}",
+	).HandlerFunc(apiDestroy(zfs, scst, locks, cfg.Zfs.Protected))
+	router.Path("/").Queries("action", "status").HandlerFunc(apiStatus(zfs))
 	router.Path("/").Queries("action", "ipcstats").HandlerFunc(apiIpcStats)
-	router.Path("/").Queries("action", "targetmount").HandlerFunc(apiTargetMount)
-	router.Path("/").Queries("action", "targetenable").HandlerFunc(apiTargetEnable)
-	router.Path("/").Queries("action", "targetdisable").HandlerFunc(apiTargetDisable)
-	router.Path("/").Queries("action", "release").HandlerFunc(apiRelease)
+	router.Path("/").Queries("action", "targetmount",
+		"deviceid", "{deviceid}",
+	).HandlerFunc(apiTargetMount(scst, locks, prefixes, mountRoot))
+	router.Path("/").Queries("action", "targetenable",
+		"tgtid", "{tgtid}",
+	).HandlerFunc(apiTargetEnable(scst, locks))
+	router.Path("/").Queries("action", "targetdisable",
+		"tgtid", "{tgtid}",
+	).HandlerFunc(apiTargetDisable(scst, locks))
+	router.Path("/").Queries("action", "release",
+		"seat", "{seat}",
+	).HandlerFunc(apiRelease(zfs, scst, locks, seats, prefixes))
 	router.Path("/").Queries("action", "reload").HandlerFunc(apiReload)
-	router.Path("/").Queries("action", "send").HandlerFunc(apiSend)
-	router.Path("/").Queries("action", "sendlist").HandlerFunc(apiSendList)
-	router.Path("/").Queries("action", "senddetails").HandlerFunc(apiSendDetails)
-	router.Path("/").Queries("action", "receivelist").HandlerFunc(apiReceiveList)
-	router.Path("/").Queries("action", "targetconfig").HandlerFunc(apiTargetConfig)
-	router.Path("/").Queries("action", "targetinfo").HandlerFunc(apiTargetInfo)
-	router.Path("/").Queries("action", "rollback").HandlerFunc(apiRollback)
+	router.Path("/").Queries("action", "send").HandlerFunc(apiSend(zfs, jobs))
+	router.Path("/").Queries("action", "sendlist").HandlerFunc(apiSendList(jobs))
+	router.Path("/").Queries("action", "senddetails",
+		"id", "{id}",
+	).HandlerFunc(apiSendDetails(jobs))
+	router.Path("/").Queries("action", "receivelist").HandlerFunc(apiReceiveList(jobs))
+	router.Path("/").Queries("action", "receivinglog",
+		"id", "{id}",
+	).HandlerFunc(apiReceivingLog(jobs))
+	router.Path("/").Queries("action", "canceljob",
+		"id", "{id}",
+	).HandlerFunc(apiCancelJob(jobs))
+	router.Path("/").Queries("action", "targetconfig",
+		"tgtid", "{tgtid}",
+	).HandlerFunc(apiTargetConfig(scst, locks))
+	router.Path("/").Queries("action", "targetinfo",
+		"tgtid", "{tgtid}",
+	).HandlerFunc(apiTargetInfo(scst))
+	router.Path("/").Queries("action", "rollback",
+		"dataset", "{dataset}",
+	).HandlerFunc(apiRollback(zfs, scst, locks))
 	router.Path("/").Queries("action", "version").HandlerFunc(apiVersion)
-	router.Path("/").Queries("action", "targetcreate").HandlerFunc(apiTargetCreate)
-	router.Path("/").Queries("action", "diffcreate").HandlerFunc(apiDiffCreate)
+	router.Path("/").Queries("action", "targetcreate",
+		"dataset", "{dataset}",
+		"deviceid", "{deviceid}",
+	).HandlerFunc(apiTargetCreate(zfs, scst, locks, iqnPrefix))
+	router.Path("/").Queries("action", "diffcreate").HandlerFunc(apiDiffCreate(zfs))
 	router.Path("/").Queries("action", "smartclone",
 		"clonesource", "{clonesource}",
 		"clonename", "{clonename}",
 		"deviceid", "{deviceid}",
-	).HandlerFunc(apiSmartClone(cfg.Apis.ZfsApi, cfg.Apis.ScstApi))
-	router.Path("/").Queries("action", "lastsnapshot").HandlerFunc(apiLastSnapshot)
-	router.Path("/").Queries("action", "startreceiving").HandlerFunc(apiStartReceiving)
-	router.Path("/").Queries("action", "replicate").HandlerFunc(apiReplicate)
+	).HandlerFunc(apiSmartClone(zfs, scst, locks))
+	router.Path("/").Queries("action", "lastsnapshot",
+		"dataset", "{dataset}",
+	).HandlerFunc(apiLastSnapshot(zfs))
+	router.Path("/").Queries("action", "startreceiving",
+		"dataset", "{dataset}",
+	).HandlerFunc(apiStartReceiving(zfs, locks, jobs, cfg.Peers))
+	router.Path("/").Queries("action", "replicate",
+		"dataset", "{dataset}",
+	).HandlerFunc(apiReplicate(zfs, locks, cfg.Server.Url, cfg.Peers))
 	router.Path("/").Queries("action", "smartclone2",
 		"systemmaster", "{systemmaster}",
 		"gamesmaster", "{gamesmaster}",
-		"gamesid", "{gamesid}").HandlerFunc(apiSmartClone2(cfg.Apis.ZfsApi, cfg.Apis.ScstApi))
+		"gamesid", "{gamesid}").HandlerFunc(apiSmartClone2(zfs, scst, locks, prefixes))
 	/*router.Path("/").Queries("action", "smartclone2",
 	"systemmaster", "{systemmaster}",
 	"gamesmaster", "{gamesmaster}",
 	"systemclone", "{systemclone}",
-	"gamesid", "{gamesid}").HandlerFunc(apiSmartClone2(cfg.Apis.ZfsApi, cfg.Apis.ScstApi))*/
+	"gamesid", "{gamesid}").HandlerFunc(apiSmartClone2(zfs, scst))*/
 	router.Path("/").Queries("action", "checkclone",
 		"clonesource", "{clonesource}",
 		"clonename", "{clonename}",
-	).HandlerFunc(apiCheckClone(cfg.Apis.ZfsApi))
+	).HandlerFunc(apiCheckClone(zfs, scst))
+	router.Path("/").Queries("action", "locks").HandlerFunc(apiLocks(locks))
+	router.Path("/").Queries("action", "seats").HandlerFunc(apiSeats(zfs, scst, seats, prefixes))
+	router.Path("/").Queries("action", "schema").HandlerFunc(apiSchema)
 	router.Path("/").Queries("action", "test").HandlerFunc(apiTest)
 	router.Use(loggingMiddleware)
+	router.Use(pkapi.FormatMiddleware)
 	log.Fatal(http.ListenAndServe(addrString, router))
 }
 
-func apiSnapshot(apiZfs string) http.HandlerFunc {
+func apiSnapshot(zfs ZfsBackend) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var (
 			res XmlResponse
@@ -155,10 +173,10 @@ func apiSnapshot(apiZfs string) http.HandlerFunc {
 			res.SetVal("snapname", mux.Vars(r)["snapname"])
 		}
 
-		if res.Fields["snapname"] == "null" || res.Fields["snapsource"] == "null" {
+		if res.Fields.Get("snapname") == "null" || res.Fields.Get("snapsource") == "null" {
 			res.Error("missing snapshot source or snapshot name.")
 		} else {
-			if err = ZfsCreateSnapshot(apiZfs, mux.Vars(r)["snapsource"], mux.Vars(r)["snapname"]); err != nil {
+			if err = zfs.CreateSnapshot(r.Context(), mux.Vars(r)["snapsource"], mux.Vars(r)["snapname"]); err != nil {
 				res.Error("log file not empty.")
 				Log := make([]string, 0)
 				Log = append(Log, err.Error())
@@ -171,16 +189,175 @@ func apiSnapshot(apiZfs string) http.HandlerFunc {
 		res.Write(&w)
 	}
 }
-func apiBookmark(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "bookmark")
+func apiBookmark(zfs ZfsBackend, locks *LockManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			res       XmlResponse
+			journal   stepJournal
+			bookmarks []string
+			release   func()
+			err       error
+		)
+		dataset := mux.Vars(r)["dataset"]
+		mode := r.URL.Query().Get("mode")
+		if mode == "" {
+			mode = bookmarkCreate
+		}
+		res.SetAction("bookmark")
+		res.SetVal("dataset", dataset)
+		res.SetVal("mode", mode)
+		if mode == bookmarkList {
+			if bookmarks, err = zfs.ListBookmarks(r.Context(), dataset); err != nil {
+				res.Error(err.Error())
+			} else {
+				res.Success()
+				res.Log = &XmlData{Entries: bookmarks}
+			}
+			res.Write(&w)
+			return
+		}
+		snapshot := datasetMember(dataset, r.URL.Query().Get("snapshot"), "@")
+		// Bookmark is named after its snapshot by default
+		bookmark := r.URL.Query().Get("bookmark")
+		if bookmark == "" && strings.Contains(snapshot, "@") {
+			bookmark = strings.SplitN(snapshot, "@", 2)[1]
+		}
+		bookmark = datasetMember(dataset, bookmark, "#")
+		if snapshot != "" {
+			res.SetVal("snapshot", snapshot)
+		}
+		res.SetVal("bookmark", bookmark)
+		switch {
+		case mode != bookmarkCreate && mode != bookmarkDelete && mode != bookmarkReplace:
+			err = fmt.Errorf("unknown bookmark mode: %s", mode)
+		case mode != bookmarkDelete && !strings.HasPrefix(snapshot, dataset+"@"):
+			err = fmt.Errorf("missing snapshot of %s", dataset)
+		case !strings.HasPrefix(bookmark, dataset+"#"):
+			err = fmt.Errorf("missing bookmark of %s", dataset)
+		}
+		if err != nil {
+			res.Error(err.Error())
+			res.Write(&w)
+			return
+		}
+		if release, err = lockRequest(locks, r, "bookmark", datasetLock(dataset)); err != nil {
+			res.Error(err.Error())
+			res.Write(&w)
+			return
+		}
+		defer release()
+		if mode == bookmarkDelete {
+			err = zfs.DestroyBookmark(r.Context(), bookmark)
+		} else {
+			err = bookmarkSnapshot(r.Context(), zfs, &journal, snapshot, bookmark, mode == bookmarkReplace)
+		}
+		if err != nil {
+			res.Error(err.Error())
+		} else {
+			res.Success()
+		}
+		if len(journal.steps) > 0 {
+			res.Log = &XmlData{Entries: journal.Steps()}
+		}
+		res.Write(&w)
+	}
 }
-func apiClone(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "clone")
+func apiClone(zfs ZfsBackend, locks *LockManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			res     XmlResponse
+			journal stepJournal
+			origin  string
+			release func()
+			err     error
+		)
+		clonesource := mux.Vars(r)["clonesource"]
+		clonename := mux.Vars(r)["clonename"]
+		// Snapshot name without dataset is a snapshot of clone source
+		snapshot := r.URL.Query().Get("snapshot")
+		if snapshot != "" && !strings.Contains(snapshot, "@") {
+			snapshot = clonesource + "@" + snapshot
+		}
+		props := make(map[string]string)
+		res.SetAction("clone")
+		res.SetVal("clonesource", clonesource)
+		res.SetVal("clonename", clonename)
+		if snapshot != "" {
+			res.SetVal("snapshot", snapshot)
+		}
+		for _, name := range cloneSettableProperties {
+			if value := r.URL.Query().Get(name); value != "" {
+				props[name] = value
+				res.SetVal(name, value)
+			}
+		}
+		if release, err = lockRequest(locks, r, "clone", datasetLock(clonename)); err != nil {
+			res.Error(err.Error())
+			res.Write(&w)
+			return
+		}
+		defer release()
+		if origin, err = newClone(r.Context(), zfs, &journal, clonename, clonesource, snapshot, props); err != nil {
+			res.Error(err.Error())
+		} else {
+			res.Success()
+			res.SetVal("origin", origin)
+		}
+		if len(journal.steps) > 0 {
+			res.Log = &XmlData{Entries: journal.Steps()}
+		}
+		res.Write(&w)
+	}
 }
-func apiDestroy(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "destroy")
+func apiDestroy(zfs ZfsBackend, scst ScstBackend, locks *LockManager, protected []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			res       XmlResponse
+			destroyed []string
+			release   func()
+			err       error
+		)
+		dataset := mux.Vars(r)["dataset"]
+		deviceid := r.URL.Query().Get("deviceid")
+		opts := ZfsDestroyOptions{
+			Recursive: queryFlag(r, "recursive"),
+			Deferred:  queryFlag(r, "deferred"),
+		}
+		res.SetAction("destroy")
+		res.SetVal("dataset", dataset)
+		if deviceid != "" {
+			res.SetVal("deviceid", deviceid)
+		}
+		if opts.Recursive {
+			res.SetVal("recursive", "1")
+		}
+		if opts.Deferred {
+			res.SetVal("deferred", "1")
+		}
+		keys := []string{datasetLock(strings.SplitN(dataset, "@", 2)[0])}
+		if deviceid != "" {
+			keys = append(keys, deviceLock(deviceid))
+		}
+		if release, err = lockRequest(locks, r, "destroy", keys...); err != nil {
+			res.Error(err.Error())
+			res.Write(&w)
+			return
+		}
+		defer release()
+		if err = checkDestroy(r.Context(), zfs, scst, protected, dataset, deviceid, opts.Recursive); err != nil {
+			res.Error(err.Error())
+		} else {
+			if destroyed, err = zfs.DestroyDataset(r.Context(), dataset, opts); err != nil {
+				res.Error(err.Error())
+			} else {
+				res.Success()
+				res.Log = &XmlData{Entries: destroyed}
+			}
+		}
+		res.Write(&w)
+	}
 }
-func apiStatus(apiZfs string) http.HandlerFunc {
+func apiStatus(zfs ZfsBackend) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var (
 			res_in  []ZfsEntity
@@ -188,7 +365,7 @@ func apiStatus(apiZfs string) http.HandlerFunc {
 			err     error
 		)
 		res_out.Action = "status"
-		if res_in, err = ZfsListAll(apiZfs); err != nil {
+		if res_in, err = zfs.ListAll(r.Context()); err != nil {
 			res_out.Error(err.Error())
 		} else {
 			res_out.Status = "success"
@@ -200,94 +377,603 @@ func apiStatus(apiZfs string) http.HandlerFunc {
 func apiIpcStats(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "ipcstats")
 }
-func apiTargetMount(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "targetmount")
+func apiTargetMount(scst ScstBackend, locks *LockManager, prefixes ClonePrefixes, mountRoot string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			res     XmlResponse
+			journal stepJournal
+			paths   []string
+			keys    []string
+			release func()
+			err     error
+		)
+		deviceid := mux.Vars(r)["deviceid"]
+		// System disk of seat is mounted by default
+		dataset := r.URL.Query().Get("dataset")
+		if dataset == "" {
+			dataset = prefixes.System + deviceid
+		}
+		mode := r.URL.Query().Get("mode")
+		if mode == "" {
+			mode = mountMount
+		}
+		res.SetAction("targetmount")
+		res.SetVal("deviceid", deviceid)
+		res.SetVal("mode", mode)
+		if mode == mountMount {
+			res.SetVal("dataset", dataset)
+		} else if mode != mountUnmount {
+			res.Error(fmt.Sprintf("unknown mode %s", mode))
+			res.Write(&w)
+			return
+		}
+		// Locks are held while device is mounted, unmount takes them over
+		if mode == mountMount {
+			keys = mountLocks(dataset, deviceid)
+			release, err = lockRequest(locks, r, "targetmount", keys...)
+		} else {
+			if keys = locks.HeldKeys(deviceLock(deviceid), "targetmount"); keys == nil {
+				keys = mountLocks(mountedDataset(mountRoot, deviceid), deviceid)
+			}
+			release, err = reclaimRequest(locks, r, "targetmount", keys...)
+		}
+		if err != nil {
+			res.Error(err.Error())
+			res.Write(&w)
+			return
+		}
+		defer release()
+		if mode == mountMount {
+			paths, err = mountTarget(r.Context(), scst, &journal, mountRoot, dataset, deviceid)
+		} else {
+			paths, err = unmountTarget(r.Context(), scst, &journal, mountRoot, deviceid)
+		}
+		if mounts, mountsErr := targetMounts(mountRoot, deviceid); mountsErr != nil || len(mounts) > 0 {
+			locks.Hold(keys, requestId(r), "targetmount")
+		}
+		if err != nil {
+			res.Error(err.Error())
+		} else {
+			res.Success()
+		}
+		if len(paths) > 0 {
+			if mode == mountMount {
+				res.SetVal("mounted", strings.Join(paths, ","))
+			} else {
+				res.SetVal("unmounted", strings.Join(paths, ","))
+			}
+		}
+		if len(journal.steps) > 0 {
+			res.Log = &XmlData{Entries: journal.Steps()}
+		}
+		res.Write(&w)
+	}
 }
-func apiTargetEnable(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "targetenable")
+func apiTargetEnable(scst ScstBackend, locks *LockManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			res     XmlResponse
+			keys    []string
+			release func()
+			err     error
+		)
+		tgtid := mux.Vars(r)["tgtid"]
+		res.SetAction("targetenable")
+		res.SetVal("tgtid", tgtid)
+		if keys, err = targetLocks(r.Context(), scst, tgtid); err == nil {
+			release, err = lockRequest(locks, r, "targetenable", keys...)
+		}
+		if err != nil {
+			res.Error(err.Error())
+			res.Write(&w)
+			return
+		}
+		defer release()
+		if err = scst.SetTargetEnabled(r.Context(), tgtid, true); err != nil {
+			res.Error(err.Error())
+		} else {
+			res.Success()
+		}
+		res.Write(&w)
+	}
 }
-func apiTargetDisable(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "targetdisable")
+func apiTargetDisable(scst ScstBackend, locks *LockManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			res     XmlResponse
+			drain   time.Duration
+			closed  []string
+			keys    []string
+			release func()
+			err     error
+		)
+		tgtid := mux.Vars(r)["tgtid"]
+		force := queryFlag(r, "force")
+		res.SetAction("targetdisable")
+		res.SetVal("tgtid", tgtid)
+		if drain, err = querySeconds(r, "drain"); err != nil {
+			res.Error(err.Error())
+			res.Write(&w)
+			return
+		}
+		if drain > 0 {
+			res.SetVal("drain", r.URL.Query().Get("drain"))
+		}
+		if force {
+			res.SetVal("force", "1")
+		}
+		if keys, err = targetLocks(r.Context(), scst, tgtid); err == nil {
+			release, err = lockRequest(locks, r, "targetdisable", keys...)
+		}
+		if err != nil {
+			res.Error(err.Error())
+			res.Write(&w)
+			return
+		}
+		defer release()
+		if closed, err = disableTarget(r.Context(), scst, tgtid, drain, force); err != nil {
+			res.Error(err.Error())
+		} else {
+			res.Success()
+			if len(closed) > 0 {
+				res.SetVal("closed", strings.Join(closed, ","))
+			}
+		}
+		res.Write(&w)
+	}
 }
-func apiRelease(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "release")
+func apiRelease(zfs ZfsBackend, scst ScstBackend, locks *LockManager, seats *SeatInventory, prefixes ClonePrefixes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			res     XmlResponseSC2
+			seat    Seat
+			drain   time.Duration = SEAT_RELEASE_DRAIN
+			release func()
+			err     error
+		)
+		id := mux.Vars(r)["seat"]
+		res.SetAction("release")
+		res.SetVal("seat", id)
+		if seat, err = seats.Get(id); err != nil {
+			res.Error(err.Error())
+			res.Write(&w)
+			return
+		}
+		res.SetVal("gamesid", seat.GamesId)
+		if r.URL.Query().Get("drain") != "" {
+			if drain, err = querySeconds(r, "drain"); err != nil {
+				res.Error(err.Error())
+				res.Write(&w)
+				return
+			}
+		}
+		systemClone := prefixes.System + seat.Id
+		gamesClone := prefixes.Games + seat.GamesId
+		if release, err = lockRequest(locks, r, "release",
+			datasetLock(systemClone), deviceLock(seat.Id),
+			datasetLock(gamesClone), deviceLock(seat.GamesId)); err != nil {
+			res.Error(err.Error())
+			res.Write(&w)
+			return
+		}
+		defer release()
+		deviceids := []string{seat.Id, seat.GamesId}
+		seats.SetState(id, seatReleasing, 0, nil)
+		started := time.Now()
+		err = drainSeat(r.Context(), scst, deviceids, drain)
+		res.SetVal("waited", seconds(time.Since(started)))
+		if err != nil {
+			seats.SetState(id, seatBusy, 0, err)
+			res.SetVal("state", seatBusy)
+			res.Error(err.Error())
+			res.Write(&w)
+			return
+		}
+		started = time.Now()
+		desktop := smartCloneDisk(r.Context(), zfs, scst, systemClone, seat.SystemMaster, seat.Id, false)
+		games := smartCloneDisk(r.Context(), zfs, scst, gamesClone, seat.GamesMaster, seat.GamesId, false)
+		duration := time.Since(started)
+		res.Desktop, res.Games = &desktop, &games
+		res.SetVal("duration", seconds(duration))
+		if desktop.Status == "success" && games.Status == "success" {
+			seats.SetState(id, seatFree, duration, nil)
+			res.SetVal("state", seatFree)
+			res.Success()
+		} else {
+			err = errors.New("one or more disks failed to reset")
+			seats.SetState(id, seatFailed, duration, err)
+			res.SetVal("state", seatFailed)
+			res.Error(err.Error())
+		}
+		res.Write(&w)
+	}
 }
 func apiReload(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "reload")
 }
-func apiSend(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "send")
+func apiSend(zfs ZfsBackend, jobs *JobManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			res  XmlResponse
+			size int64
+			err  error
+		)
+		opts := ZfsSendOptions{
+			Snapshot:     r.URL.Query().Get("snapshot"),
+			From:         r.URL.Query().Get("from"),
+			Intermediate: queryFlag(r, "intermediate"),
+			Compressed:   queryFlag(r, "compressed"),
+			Raw:          queryFlag(r, "raw"),
+			ResumeToken:  r.URL.Query().Get("resumetoken"),
+		}
+		// Short incremental source is a snapshot of the same dataset,
+		// bookmarks are given as #name
+		if opts.From != "" && !strings.ContainsAny(opts.From, "@#") {
+			opts.From = "@" + opts.From
+		}
+		res.SetAction("send")
+		if opts.ResumeToken != "" {
+			res.SetVal("resumetoken", opts.ResumeToken)
+		} else {
+			res.SetVal("snapshot", opts.Snapshot)
+			if opts.From != "" {
+				res.SetVal("from", opts.From)
+			}
+		}
+		if opts.ResumeToken == "" && !strings.Contains(opts.Snapshot, "@") {
+			res.Error("missing snapshot or resume token")
+			res.Write(&w)
+			return
+		}
+		source := opts.Snapshot
+		if opts.ResumeToken != "" {
+			source = opts.ResumeToken
+		}
+		job, ctx := jobs.Start(r.Context(), jobSend, source, r.RemoteAddr)
+		w.Header().Set(jobIdHeader, job.Id())
+		// Size is only an estimate for progress, send goes on without it
+		if size, err = zfs.SendSize(ctx, opts); err == nil {
+			job.SetTotal(size)
+			w.Header().Set(sendSizeHeader, strconv.FormatInt(size, 10))
+		}
+		stream := &sendStreamWriter{w: w}
+		err = zfs.Send(ctx, opts, job.Writer(stream))
+		job.Finish(ctx, err)
+		if err != nil {
+			if !stream.started {
+				res.Error(err.Error())
+				res.Write(&w)
+				return
+			}
+			// Connection is aborted so receiver does not take broken
+			// stream as complete one
+			panic(http.ErrAbortHandler)
+		}
+	}
 }
-func apiSendList(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "sendlist")
+func apiJobList(jobs *JobManager, action string, kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			res XmlResponse
+		)
+		res.SetAction(action)
+		list := jobs.List(kind)
+		entries := make([]XmlJob, 0, len(list))
+		for _, job := range list {
+			entries = append(entries, job.Info())
+		}
+		res.Success()
+		res.Log = &XmlData{Entries: entries}
+		res.Write(&w)
+	}
 }
-func apiSendDetails(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "senddetails")
+func apiSendList(jobs *JobManager) http.HandlerFunc {
+	return apiJobList(jobs, "sendlist", jobSend)
 }
-func apiReceiveList(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "receivelist")
+func apiSendDetails(jobs *JobManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			res XmlResponse
+			job *Job
+			err error
+		)
+		res.SetAction("senddetails")
+		res.SetVal("id", mux.Vars(r)["id"])
+		if job, err = jobs.Get(mux.Vars(r)["id"]); err != nil {
+			res.Error(err.Error())
+		} else {
+			res.Success()
+			info := job.Info()
+			res.SetVal("kind", info.Kind)
+			res.SetVal("source", info.Source)
+			res.SetVal("destination", info.Destination)
+			res.SetVal("state", info.State)
+			res.SetVal("bytes", info.Bytes)
+			res.SetVal("total", info.Total)
+			res.SetVal("rate", info.Rate)
+			res.SetVal("eta", info.Eta)
+			res.SetVal("started", info.Started)
+			res.SetVal("finished", info.Finished)
+			res.SetVal("error", info.Error)
+		}
+		res.Write(&w)
+	}
 }
-func apiTargetConfig(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "targetconfig")
+func apiReceiveList(jobs *JobManager) http.HandlerFunc {
+	return apiJobList(jobs, "receivelist", jobReceive)
 }
-func apiTargetInfo(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "targetinfo")
+func apiTargetConfig(scst ScstBackend, locks *LockManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			res     XmlResponse
+			journal stepJournal
+			params  map[string]string = make(map[string]string)
+			keys    []string
+			release func()
+			err     error
+		)
+		tgtid := mux.Vars(r)["tgtid"]
+		res.SetAction("targetconfig")
+		res.SetVal("tgtid", tgtid)
+		// Target parameters are capitalized like MaxRecvDataSegmentLength,
+		// the other query parameters belong to api
+		for name, values := range r.URL.Query() {
+			if name != "" && unicode.IsUpper(rune(name[0])) {
+				params[name] = values[0]
+			}
+		}
+		if keys, err = targetLocks(r.Context(), scst, tgtid); err == nil {
+			release, err = lockRequest(locks, r, "targetconfig", keys...)
+		}
+		if err != nil {
+			res.Error(err.Error())
+			res.Write(&w)
+			return
+		}
+		defer release()
+		if err = configureTarget(r.Context(), scst, &journal, tgtid, params); err != nil {
+			res.Error(err.Error())
+		} else {
+			res.Success()
+		}
+		if len(journal.steps) > 0 {
+			res.Log = &XmlData{Entries: journal.Steps()}
+		}
+		res.Write(&w)
+	}
 }
-func apiRollback(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "rollback")
+func apiTargetInfo(scst ScstBackend) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			res    XmlResponse
+			target ScstTarget
+			err    error
+		)
+		tgtid := mux.Vars(r)["tgtid"]
+		res.SetAction("targetinfo")
+		res.SetVal("tgtid", tgtid)
+		if target, err = scst.IscsiTargetInfo(r.Context(), tgtid); err != nil {
+			res.Error(err.Error())
+		} else {
+			res.Success()
+			res.SetVal("target", target.Name)
+			if target.Enabled {
+				res.SetVal("enabled", "1")
+			} else {
+				res.SetVal("enabled", "0")
+			}
+			res.Log = &XmlData{Entries: targetInfoEntries(target)}
+		}
+		res.Write(&w)
+	}
+}
+func apiRollback(zfs ZfsBackend, scst ScstBackend, locks *LockManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			res       XmlResponse
+			journal   stepJournal
+			discarded []string
+			release   func()
+			err       error
+		)
+		dataset := mux.Vars(r)["dataset"]
+		deviceid := r.URL.Query().Get("deviceid")
+		recursive := queryFlag(r, "recursive")
+		// Rollback to @0 baseline snapshot by default
+		snapshot := r.URL.Query().Get("snapshot")
+		if snapshot == "" {
+			snapshot = "0"
+		}
+		if !strings.Contains(snapshot, "@") {
+			snapshot = dataset + "@" + snapshot
+		}
+		res.SetAction("rollback")
+		res.SetVal("dataset", dataset)
+		res.SetVal("snapshot", snapshot)
+		if deviceid != "" {
+			res.SetVal("deviceid", deviceid)
+		}
+		if recursive {
+			res.SetVal("recursive", "1")
+		}
+		if !strings.HasPrefix(snapshot, dataset+"@") {
+			res.Error(fmt.Sprintf("%s is not a snapshot of %s", snapshot, dataset))
+			res.Write(&w)
+			return
+		}
+		keys := []string{datasetLock(dataset)}
+		if deviceid != "" {
+			keys = append(keys, deviceLock(deviceid))
+		}
+		if release, err = lockRequest(locks, r, "rollback", keys...); err != nil {
+			res.Error(err.Error())
+			res.Write(&w)
+			return
+		}
+		defer release()
+		if discarded, err = rollbackDataset(r.Context(), zfs, scst, &journal, snapshot, deviceid, recursive); err != nil {
+			res.Error(err.Error())
+		} else {
+			res.Success()
+			res.SetVal("discarded", strings.Join(discarded, ","))
+		}
+		if len(journal.steps) > 0 {
+			res.Log = &XmlData{Entries: journal.Steps()}
+		}
+		res.Write(&w)
+	}
 }
 func apiVersion(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "targetconfig")
 }
-func apiTargetCreate(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "targetcreate")
+func apiTargetCreate(zfs ZfsBackend, scst ScstBackend, locks *LockManager, iqnPrefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			res     XmlResponse
+			journal stepJournal
+			release func()
+			err     error
+		)
+		dataset := mux.Vars(r)["dataset"]
+		deviceid := mux.Vars(r)["deviceid"]
+		// Target name is generated from device id unless given
+		iqn := r.URL.Query().Get("iqn")
+		if iqn == "" {
+			iqn = iqnPrefix + ":" + deviceid
+		}
+		res.SetAction("targetcreate")
+		res.SetVal("dataset", dataset)
+		res.SetVal("deviceid", deviceid)
+		res.SetVal("file", zvolDevice(dataset))
+		if release, err = lockRequest(locks, r, "targetcreate", datasetLock(dataset), deviceLock(deviceid)); err != nil {
+			res.Error(err.Error())
+			res.Write(&w)
+			return
+		}
+		defer release()
+		if err = createTarget(r.Context(), zfs, scst, &journal, dataset, deviceid, iqn); err != nil {
+			res.Error(err.Error())
+		} else {
+			res.Success()
+			res.SetVal("target", iqn)
+		}
+		if len(journal.steps) > 0 {
+			res.Log = &XmlData{Entries: journal.Steps()}
+		}
+		res.Write(&w)
+	}
 }
-func apiDiffCreate(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "diffcreate")
+func apiDiffCreate(zfs ZfsBackend) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			res       XmlResponse
+			cloneinfo map[string]string
+			entries   []XmlDiffEntry
+			more      bool
+			offset    int
+			limit     int = DIFF_PAGE_LIMIT
+			err       error
+		)
+		clonename := r.URL.Query().Get("clonename")
+		from := r.URL.Query().Get("from")
+		to := r.URL.Query().Get("to")
+		res.SetAction("diffcreate")
+		if value := r.URL.Query().Get("offset"); value != "" {
+			if offset, err = strconv.Atoi(value); err != nil || offset < 0 {
+				err = fmt.Errorf("invalid offset value: %s", value)
+			}
+		}
+		if value := r.URL.Query().Get("limit"); value != "" && err == nil {
+			if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+				err = fmt.Errorf("invalid limit value: %s", value)
+			}
+		}
+		if err == nil {
+			// Clone is compared with its origin snapshot
+			if clonename != "" {
+				res.SetVal("clonename", clonename)
+				if cloneinfo, err = zfs.GetCloneInfo(r.Context(), clonename); err == nil {
+					if from, to = cloneinfo["origin"], clonename; from == "" {
+						err = fmt.Errorf("%s is not a clone", clonename)
+					}
+				}
+			} else if !strings.Contains(from, "@") {
+				err = errors.New("missing clone name or from snapshot")
+			}
+		}
+		if err == nil {
+			err = checkDiffDataset(r.Context(), zfs, from)
+		}
+		if err != nil {
+			res.Error(err.Error())
+			res.Write(&w)
+			return
+		}
+		res.SetVal("from", from)
+		res.SetVal("to", to)
+		if entries, more, err = zfs.Diff(r.Context(), from, to, offset, limit); err != nil {
+			res.Error(err.Error())
+		} else {
+			res.Success()
+			res.SetVal("offset", strconv.Itoa(offset))
+			res.SetVal("limit", strconv.Itoa(limit))
+			if more {
+				res.SetVal("more", "1")
+			}
+			res.Log = &XmlData{Entries: entries}
+		}
+		res.Write(&w)
+	}
 }
-func apiSmartClone(apiZfs string, apiScst string) http.HandlerFunc {
+func apiSmartClone(zfs ZfsBackend, scst ScstBackend, locks *LockManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var (
 			res_out   XmlResponse
 			res_in    SmartCloneInfo
 			tgtParams map[string]string
+			release   func()
 			err       error
 
 			// lastSnapshot   string
 			// cloneinfo      map[string]string = make(map[string]string)
 			// zeroSnapExists bool
 		)
+		dryrun := queryFlag(r, "dryrun")
 		res_out.Action = "smartclone"
 		res_out.SetVal("clonesource", mux.Vars(r)["clonesource"])
 		res_out.SetVal("clonename", mux.Vars(r)["clonename"])
 		res_out.SetVal("deviceid", mux.Vars(r)["deviceid"])
-		if tgtParams, err = ScstGetIscsiTargetParams(apiScst, mux.Vars(r)["deviceid"]); err != nil {
+		if !dryrun {
+			if release, err = lockRequest(locks, r, "smartclone",
+				datasetLock(mux.Vars(r)["clonename"]), deviceLock(mux.Vars(r)["deviceid"])); err != nil {
+				res_out.Error(err.Error())
+				res_out.Write(&w)
+				return
+			}
+			defer release()
+		}
+		if tgtParams, err = scst.IscsiTargetParams(r.Context(), mux.Vars(r)["deviceid"]); err != nil {
 			res_out.Error(err.Error())
 		} else {
-			if res_in, err = smartClone(apiZfs, apiScst, mux.Vars(r)["clonename"], mux.Vars(r)["clonesource"], mux.Vars(r)["deviceid"]); err != nil {
+			if res_in, err = smartClone(r.Context(), zfs, scst, mux.Vars(r)["clonename"], mux.Vars(r)["clonesource"], mux.Vars(r)["deviceid"], dryrun); err != nil {
 				res_out.Error(err.Error())
 			} else {
 				res_out.Success()
 				res_out.SetVal("target", tgtParams["wwn"])
 			}
 		}
-		if res_in.actualclone != "" {
-			res_out.SetVal("actualclone", res_in.actualclone)
-		}
-		res_out.SetVal("lastsnapshot", res_in.lastsnapshot)
-		res_out.SetVal("origin", res_in.origin)
-		res_out.SetVal("written", res_in.written)
+		setSmartCloneVals(&res_out, res_in, dryrun)
 
 		/*
 			//Get last snapshot of clone source
-			if lastSnapshot, err = ZfsGetLastSnapshot(apiZfs, mux.Vars(r)["clonesource"]); err != nil {
+			if lastSnapshot, err = zfs.GetLastSnapshot(r.Context(), mux.Vars(r)["clonesource"]); err != nil {
 				res.Error(err.Error())
 			} else {
 				if lastSnapshot == "" {
 					res.Error(fmt.Sprintf("there is no any snapshot in %s", mux.Vars(r)["clonesource"]))
 				} else {
 					res.SetVal("lastsnapshot", lastSnapshot)
-					if cloneinfo, err = ZfsGetCloneInfo(apiZfs, mux.Vars(r)["clonename"]); err != nil {
+					if cloneinfo, err = zfs.GetCloneInfo(r.Context(), mux.Vars(r)["clonename"]); err != nil {
 						res.Error(err.Error())
 					} else {
 						// Check if dataset is clone
@@ -299,25 +985,25 @@ func apiSmartClone(apiZfs string, apiScst string) http.HandlerFunc {
 							// Check if clone is modified or is not on last snapshot
 							if cloneinfo["written"] != "0" || cloneinfo["origin"] != lastSnapshot {
 								// Check if there are any established iSCSI session
-								if err = ScstCheckIscsiSessions(apiScst, mux.Vars(r)["deviceid"]); err != nil {
+								if err = ScstCheckIscsiSessions(r.Context(), scst, mux.Vars(r)["deviceid"]); err != nil {
 									res.Error(err.Error())
 								} else {
 									// Deactivate device to make it avaliable for modifications
-									if err = ScstDeactivateDevice(apiScst, mux.Vars(r)["deviceid"]); err != nil {
+									if err = scst.DeactivateDevice(r.Context(), mux.Vars(r)["deviceid"]); err != nil {
 										res.Error(err.Error())
 									} else {
 										zeroSnapshot := mux.Vars(r)["clonename"] + "@0"
-										if zeroSnapExists, err = ZfsCheckDatasetExists(apiZfs, zeroSnapshot); err != nil {
+										if zeroSnapExists, err = zfs.CheckDatasetExists(r.Context(), zeroSnapshot); err != nil {
 											res.Error(err.Error())
 										} else {
 											if cloneinfo["origin"] == lastSnapshot && zeroSnapExists {
-												ZfsRollback(apiZfs, zeroSnapshot)
+												zfs.Rollback(r.Context(), zeroSnapshot)
 											} else {
-												ZfsDestroy(apiZfs, mux.Vars(r)["clonename"])
-												ZfsCloneLast(apiZfs, mux.Vars(r)["clonename"], mux.Vars(r)["clonesource"])
-												ZfsCreateSnapshot(apiZfs, mux.Vars(r)["clonename"], "0")
+												zfs.Destroy(r.Context(), mux.Vars(r)["clonename"])
+												zfs.CloneLast(r.Context(), mux.Vars(r)["clonename"], mux.Vars(r)["clonesource"])
+												zfs.CreateSnapshot(r.Context(), mux.Vars(r)["clonename"], "0")
 											}
-											if err = ScstActivateDevice(apiScst, mux.Vars(r)["deviceid"]); err != nil {
+											if err = scst.ActivateDevice(r.Context(), mux.Vars(r)["deviceid"]); err != nil {
 												res.Error(err.Error())
 											} else {
 												res.Success()
@@ -339,32 +1025,264 @@ func apiSmartClone(apiZfs string, apiScst string) http.HandlerFunc {
 func apiZfsList(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "zfslist")
 }
-func apiLastSnapshot(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "lastsnapshot")
+func apiLastSnapshot(zfs ZfsBackend) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			res          XmlResponse
+			lastSnapshot string
+			props        map[string]string
+			clones       []string
+			err          error
+		)
+		dataset := mux.Vars(r)["dataset"]
+		res.SetAction("lastsnapshot")
+		res.SetVal("dataset", dataset)
+		if lastSnapshot, err = zfs.GetLastSnapshot(r.Context(), dataset); err != nil {
+			res.Error(err.Error())
+		} else if lastSnapshot == "" {
+			res.Error(fmt.Sprintf("there is no any snapshot in %s", dataset))
+		} else if props, err = zfs.GetProperties(r.Context(), lastSnapshot, []string{"creation", "used", "referenced"}); err != nil {
+			res.Error(err.Error())
+		} else if clones, err = zfs.GetClones(r.Context(), lastSnapshot, false); err != nil {
+			res.Error(err.Error())
+		} else {
+			res.Success()
+			res.SetVal("lastsnapshot", lastSnapshot)
+			// Creation time is in seconds since epoch
+			if creation, err := strconv.ParseInt(props["creation"], 10, 64); err == nil {
+				res.SetVal("creation", time.Unix(creation, 0).UTC().Format(time.RFC3339))
+			} else {
+				res.SetVal("creation", props["creation"])
+			}
+			res.SetVal("used", props["used"])
+			res.SetVal("referenced", props["referenced"])
+			res.SetVal("clones", strconv.Itoa(len(clones)))
+		}
+		res.Write(&w)
+	}
+}
+func apiStartReceiving(zfs ZfsBackend, locks *LockManager, jobs *JobManager, peers []Peer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			res      XmlResponse
+			body     io.Reader
+			snapshot string
+			token    string
+			release  func()
+			err      error
+		)
+		dataset := mux.Vars(r)["dataset"]
+		peerUrl := r.URL.Query().Get("url")
+		resumable := queryFlag(r, "resumable")
+		background := queryFlag(r, "background")
+		// Stream is taken from request body unless peer url is given
+		if peerUrl == "" && (r.Method == http.MethodPost || r.Method == http.MethodPut) {
+			body = r.Body
+		}
+		res.SetAction("startreceiving")
+		res.SetVal("dataset", dataset)
+		if peerUrl != "" {
+			res.SetVal("url", peerUrl)
+		}
+		if resumable {
+			res.SetVal("resumable", "1")
+		}
+		if background {
+			res.SetVal("background", "1")
+		}
+		if background && peerUrl == "" {
+			res.Error("background receive needs peer url")
+			res.Write(&w)
+			return
+		}
+		if peerUrl != "" {
+			if err = checkPeerUrl(peers, peerUrl); err != nil {
+				res.Error(err.Error())
+				res.Write(&w)
+				return
+			}
+		}
+		if release, err = lockRequest(locks, r, "startreceiving", datasetLock(dataset)); err != nil {
+			res.Error(err.Error())
+			res.Write(&w)
+			return
+		}
+		source := peerUrl
+		if source == "" {
+			source = r.RemoteAddr
+		}
+		if background {
+			// Background job is not bound to request and holds dataset lock
+			// until it finishes
+			job, ctx := jobs.Start(context.Background(), jobReceive, source, dataset)
+			go func() {
+				defer release()
+				receiveStream(ctx, zfs, job, dataset, peerUrl, nil, resumable)
+			}()
+			res.Success()
+			res.SetVal("jobid", job.Id())
+			res.Write(&w)
+			return
+		}
+		defer release()
+		job, ctx := jobs.Start(r.Context(), jobReceive, source, dataset)
+		res.SetVal("jobid", job.Id())
+		if snapshot, token, err = receiveStream(ctx, zfs, job, dataset, peerUrl, body, resumable); err != nil {
+			res.Error(err.Error())
+			if token != "" {
+				res.SetVal("resumetoken", token)
+			}
+		} else {
+			res.Success()
+			res.SetVal("snapshot", snapshot)
+		}
+		res.Write(&w)
+	}
 }
-func apiStartReceiving(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "startreceiving")
+func apiReceivingLog(jobs *JobManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			res XmlResponse
+			job *Job
+			err error
+		)
+		res.SetAction("receivinglog")
+		res.SetVal("id", mux.Vars(r)["id"])
+		if job, err = jobs.Get(mux.Vars(r)["id"]); err != nil {
+			res.Error(err.Error())
+		} else {
+			res.Success()
+			res.SetVal("state", job.State())
+			res.Log = &XmlData{Entries: job.Log()}
+		}
+		res.Write(&w)
+	}
 }
-func apiReceivingLog(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "receivinglog")
+func apiCancelJob(jobs *JobManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			res XmlResponse
+			err error
+		)
+		res.SetAction("canceljob")
+		res.SetVal("id", mux.Vars(r)["id"])
+		if err = jobs.Cancel(mux.Vars(r)["id"]); err != nil {
+			res.Error(err.Error())
+		} else {
+			res.Success()
+		}
+		res.Write(&w)
+	}
 }
 func apiReportPrometheus(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "reportprometheus")
 }
-func apiReplicate(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "replicate")
+func apiReplicate(zfs ZfsBackend, locks *LockManager, selfUrl string, peers []Peer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			res      XmlResponse
+			replicas []XmlReplica
+			targets  []Peer
+			release  func()
+			err      error
+		)
+		dataset := mux.Vars(r)["dataset"]
+		name := r.URL.Query().Get("peer")
+		res.SetAction("replicate")
+		res.SetVal("dataset", dataset)
+		// All configured peers unless one is given
+		for _, peer := range peers {
+			if name == "" || peer.Name == name {
+				targets = append(targets, peer)
+			}
+		}
+		if name != "" {
+			res.SetVal("peer", name)
+		}
+		if len(targets) == 0 {
+			if name != "" {
+				res.Error(fmt.Sprintf("unknown peer: %s", name))
+			} else {
+				res.Error("there are no peers in config")
+			}
+			res.Write(&w)
+			return
+		}
+		if release, err = lockRequest(locks, r, "replicate", datasetLock(dataset)); err != nil {
+			res.Error(err.Error())
+			res.Write(&w)
+			return
+		}
+		defer release()
+		if replicas, err = replicate(r.Context(), zfs, selfUrl, targets, dataset); err != nil {
+			res.Error(err.Error())
+		} else {
+			res.Success()
+		}
+		if len(replicas) > 0 {
+			res.Log = &XmlData{Entries: replicas}
+		}
+		res.Write(&w)
+	}
+}
+func setSmartCloneVals(res *XmlResponse, info SmartCloneInfo, dryrun bool) {
+	if info.actualclone != "" {
+		res.SetVal("actualclone", info.actualclone)
+	}
+	res.SetVal("lastsnapshot", info.lastsnapshot)
+	res.SetVal("origin", info.origin)
+	res.SetVal("written", info.written)
+	if dryrun {
+		res.SetVal("dryrun", "1")
+		res.SetVal("plan", info.plan)
+		if len(info.sessions) > 0 {
+			res.SetVal("blockedby", strings.Join(info.sessions, ","))
+		}
+	}
+	if len(info.steps) > 0 {
+		res.Log = &XmlData{Entries: info.steps}
+	}
+}
+
+func smartCloneDisk(ctx context.Context, zfs ZfsBackend, scst ScstBackend, clonename string, clonesource string, deviceid string, dryrun bool) (res XmlSC2Disk) {
+	var (
+		res_in    SmartCloneInfo
+		tgtParams map[string]string
+		err       error
+	)
+	res.DeviceId = deviceid
+	res.File = "/dev/zvol/" + clonename
+	if tgtParams, err = scst.IscsiTargetParams(ctx, deviceid); err != nil {
+		res.Error(err.Error())
+	} else {
+		res.Target = tgtParams["wwn"]
+		if res_in, err = smartClone(ctx, zfs, scst, clonename, clonesource, deviceid, dryrun); err != nil {
+			res.Error(err.Error())
+		} else {
+			res.Success()
+		}
+	}
+	res.LastSnapshot = res_in.lastsnapshot
+	res.Origin = res_in.origin
+	res.Written = res_in.written
+	res.CloneSnapshot = res_in.clonesnapshot
+	res.ActualClone = res_in.actualclone
+	res.Steps = res_in.steps
+	if dryrun {
+		res.Plan = res_in.plan
+		res.BlockedBy = strings.Join(res_in.sessions, ",")
+	}
+	return
 }
-func apiSmartClone2(apiZfs string, apiScst string) http.HandlerFunc {
+
+func apiSmartClone2(zfs ZfsBackend, scst ScstBackend, locks *LockManager, prefixes ClonePrefixes) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var (
-			res         XmlResponseGeneric
+			res         XmlResponseSC2
 			systemClone string
 			gamesClone  string
 			systemId    string
 			gamesId     string
-			res_in      SmartCloneInfo
-			res_out     XmlResponseGeneric
-			err         error
 		)
 		res.SetAction("smartclone2")
 		params := r.URL.Query()
@@ -373,7 +1291,8 @@ func apiSmartClone2(apiZfs string, apiScst string) http.HandlerFunc {
 			if systemIdCheck, ok := params["systemid"]; !ok {
 				res.Error("systemid not supplied")
 			} else {
-				systemClone = "data/kvm/desktop/" + systemIdCheck[0]
+				systemId = systemIdCheck[0]
+				systemClone = prefixes.System + systemId
 			}
 		} else {
 			systemClone = systemCloneCheck[0]
@@ -386,44 +1305,64 @@ func apiSmartClone2(apiZfs string, apiScst string) http.HandlerFunc {
 		}
 
 		if gamesCloneCheck, ok := params["gamesclone"]; !ok {
-			if gamesIdCheck, ok := params["gamesid"]; !ok {
-				res.Error("gamesid not supplied")
-			} else {
-				systemClone = "data/kvm/desktop/" + gamesIdCheck[0]
-			}
+			gamesId = mux.Vars(r)["gamesid"]
+			gamesClone = prefixes.Games + gamesId
 		} else {
 			gamesClone = gamesCloneCheck[0]
-			if gamesIdCheck, ok := params["gamesid"]; !ok {
+			if gamesIdCheck, ok := params["gamesid"]; !ok || gamesIdCheck[0] == "" {
 				gamesCloneSplit := strings.Split(gamesClone, "/")
 				gamesId = gamesCloneSplit[len(gamesCloneSplit)-1]
 			} else {
-				systemId = gamesIdCheck[0]
+				gamesId = gamesIdCheck[0]
 			}
 		}
 
-		if res_in, err = smartClone(apiZfs, apiScst, systemClone, mux.Vars(r)["systemmaster"], systemId); err != nil {
-			res_out.Error(err.Error())
+		dryrun := queryFlag(r, "dryrun")
+		if res.Status != "error" && !dryrun {
+			if release, err := lockRequest(locks, r, "smartclone2",
+				datasetLock(systemClone), deviceLock(systemId),
+				datasetLock(gamesClone), deviceLock(gamesId)); err != nil {
+				res.Error(err.Error())
+			} else {
+				defer release()
+			}
 		}
-		if res_in, err = smartClone(apiZfs, apiScst, systemClone, mux.Vars(r)["gamesmaster"], gamesId); err != nil {
-			res_out.Error(err.Error())
+		if res.Status != "error" {
+			desktop := smartCloneDisk(r.Context(), zfs, scst, systemClone, mux.Vars(r)["systemmaster"], systemId, dryrun)
+			games := smartCloneDisk(r.Context(), zfs, scst, gamesClone, mux.Vars(r)["gamesmaster"], gamesId, dryrun)
+			res.Desktop, res.Games = &desktop, &games
+			if res.Desktop.Status == "success" && res.Games.Status == "success" {
+				res.Success()
+			} else {
+				res.Error("one or more disks failed to reset")
+			}
 		}
-		log.Println(res_in)
+		res.Write(&w)
 	}
 }
-func apiCheckClone(apiZfs string) http.HandlerFunc {
+func apiCheckClone(zfs ZfsBackend, scst ScstBackend) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var (
 			lastSnapshot string
-			res          XmlResponseGeneric
+			res          XmlResponse
+			res_in       SmartCloneInfo
 			err          error
 			cloneinfo    map[string]string = make(map[string]string)
 		)
 		res.SetAction("checkclone")
-		if lastSnapshot, err = ZfsGetLastSnapshot(apiZfs, mux.Vars(r)["clonesource"]); err != nil {
+		if queryFlag(r, "dryrun") {
+			// Plan smartclone. iSCSI sessions are checked only if deviceid is supplied
+			if res_in, err = smartClone(r.Context(), zfs, scst, mux.Vars(r)["clonename"], mux.Vars(r)["clonesource"], r.URL.Query().Get("deviceid"), true); err != nil {
+				res.Error(err.Error())
+			} else {
+				res.Success()
+			}
+			setSmartCloneVals(&res, res_in, true)
+		} else if lastSnapshot, err = zfs.GetLastSnapshot(r.Context(), mux.Vars(r)["clonesource"]); err != nil {
 			res.Error(err.Error())
 		} else {
 			res.SetVal("lastsnapshot", lastSnapshot)
-			if cloneinfo, err = ZfsGetCloneInfo(apiZfs, mux.Vars(r)["clonename"]); err != nil {
+			if cloneinfo, err = zfs.GetCloneInfo(r.Context(), mux.Vars(r)["clonename"]); err != nil {
 				res.Error(err.Error())
 			} else {
 				if cloneinfo["origin"] == "" {
@@ -438,8 +1377,82 @@ func apiCheckClone(apiZfs string) http.HandlerFunc {
 					}
 				}
 			}
-			res.Write(&w)
 		}
+		res.Write(&w)
+	}
+}
+
+// Check if boolean flag is set in request query
+func queryFlag(r *http.Request, name string) bool {
+	switch strings.ToLower(r.URL.Query().Get(name)) {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
+
+// Duration given in seconds by query parameter, zero when it is not set
+func querySeconds(r *http.Request, name string) (res time.Duration, err error) {
+	var seconds int
+	if value := r.URL.Query().Get(name); value != "" {
+		if seconds, err = strconv.Atoi(value); err != nil || seconds < 0 {
+			err = fmt.Errorf("invalid %s value: %s", name, value)
+		} else {
+			res = time.Duration(seconds) * time.Second
+		}
+	}
+	return
+}
+
+func apiLocks(locks *LockManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			res XmlResponse
+		)
+		res.SetAction("locks")
+		res.Success()
+		res.Log = &XmlData{Entries: locks.List()}
+		res.Write(&w)
+	}
+}
+
+func apiSeats(zfs ZfsBackend, scst ScstBackend, seats *SeatInventory, prefixes ClonePrefixes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			res   XmlResponse
+			seat  Seat
+			state string
+			err   error
+		)
+		res.SetAction("seats")
+		for _, entry := range seats.List() {
+			if seat, err = seats.Get(entry.Id); err != nil {
+				continue
+			}
+			// Seat state stays as it was when disks can not be checked
+			if state, err = seatLiveState(r.Context(), zfs, scst, prefixes, seat); err == nil {
+				seats.Observe(seat.Id, state)
+			}
+		}
+		res.Success()
+		res.Log = &XmlData{Entries: seats.List()}
+		res.Write(&w)
+	}
+}
+
+func apiSchema(w http.ResponseWriter, r *http.Request) {
+	var (
+		res XmlResponseGeneric
+	)
+	name := r.URL.Query().Get("name")
+	if schema, ok := pkapi.ResponseSchemas[name]; ok {
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprint(w, schema.Xsd(name))
+	} else {
+		res.SetAction("schema")
+		res.SetVal("name", name)
+		res.Error(fmt.Sprintf("there is no schema for action %s", name))
+		res.Write(&w)
 	}
 }
 
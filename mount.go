@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Directory where zvol partitions are mounted for inspection, partitions of
+// device are mounted to <root>/<deviceid>/part<N>
+const MOUNT_ROOT string = "/mnt/pkapi"
+
+const (
+	mountMount   string = "mount"
+	mountUnmount string = "unmount"
+)
+
+// File in <root>/<deviceid> keeping name of mounted dataset
+const mountDatasetFile string = "dataset"
+
+// Run command on the storage host, its error output is returned as error
+func runCommand(ctx context.Context, name string, args ...string) (err error) {
+	var (
+		stderr bytes.Buffer
+	)
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = errors.New(msg)
+		}
+		log.Println(err.Error())
+	}
+	return
+}
+
+// Partition devices of zvol created by udev, ordered by partition number
+func zvolPartitions(dataset string) (res []string, err error) {
+	if res, err = filepath.Glob(zvolDevice(dataset) + "-part*"); err != nil {
+		return
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if len(res[i]) != len(res[j]) {
+			return len(res[i]) < len(res[j])
+		}
+		return res[i] < res[j]
+	})
+	return
+}
+
+// Mount points of device partitions, empty when device is not mounted
+func targetMounts(root string, deviceid string) (res []string, err error) {
+	var (
+		entries []os.FileInfo
+	)
+	if entries, err = ioutil.ReadDir(filepath.Join(root, deviceid)); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			res = append(res, filepath.Join(root, deviceid, entry.Name()))
+		}
+	}
+	return
+}
+
+// Dataset mounted for device, empty when it is not recorded
+func mountedDataset(root string, deviceid string) string {
+	data, err := ioutil.ReadFile(filepath.Join(root, deviceid, mountDatasetFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Lock keys held while device is mounted
+func mountLocks(dataset string, deviceid string) (keys []string) {
+	if dataset != "" {
+		keys = append(keys, datasetLock(dataset))
+	}
+	return append(keys, deviceLock(deviceid))
+}
+
+// Hold locks of devices left mounted by previous run so that nothing
+// modifies their datasets until they are unmounted
+func holdMountLocks(locks *LockManager, root string) (err error) {
+	var (
+		entries []os.FileInfo
+		mounts  []string
+	)
+	if entries, err = ioutil.ReadDir(root); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		deviceid := entry.Name()
+		if mounts, err = targetMounts(root, deviceid); err != nil {
+			return
+		}
+		if len(mounts) > 0 {
+			locks.Hold(mountLocks(mountedDataset(root, deviceid), deviceid), "startup", "targetmount")
+		}
+	}
+	return
+}
+
+// Deactivate SCST device of seat and mount zvol partitions read-only. Device
+// with active iSCSI sessions is not touched. Partitions without filesystem,
+// like Microsoft reserved one, are skipped. Mount points are returned
+func mountTarget(ctx context.Context, scst ScstBackend, journal *stepJournal, root string, dataset string, deviceid string) (mounted []string, err error) {
+	var (
+		partitions []string
+		existing   []string
+	)
+	if existing, err = targetMounts(root, deviceid); err != nil {
+		return
+	}
+	if len(existing) > 0 {
+		return nil, fmt.Errorf("%s is already mounted: %s", deviceid, strings.Join(existing, ","))
+	}
+	if partitions, err = zvolPartitions(dataset); err != nil {
+		return
+	}
+	if len(partitions) == 0 {
+		return nil, fmt.Errorf("there are no partitions on %s", zvolDevice(dataset))
+	}
+	if err = ScstCheckIscsiSessions(ctx, scst, deviceid); err != nil {
+		return
+	}
+	ctx, cancel := stepsContext(ctx)
+	defer cancel()
+	if err = journal.do("deactivate "+deviceid,
+		func() error { return scst.DeactivateDevice(ctx, deviceid) },
+		func() error { return scst.ActivateDevice(ctx, deviceid) }); err != nil {
+		return
+	}
+	deviceDir := filepath.Join(root, deviceid)
+	datasetFile := filepath.Join(deviceDir, mountDatasetFile)
+	if err = journal.do("create "+deviceDir,
+		func() error {
+			if err := os.MkdirAll(deviceDir, 0755); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(datasetFile, []byte(dataset+"\n"), 0644)
+		},
+		func() error {
+			os.Remove(datasetFile)
+			return os.Remove(deviceDir)
+		}); err != nil {
+		journal.rollback()
+		return
+	}
+	for _, partition := range partitions {
+		partition := partition
+		dir := filepath.Join(deviceDir, strings.TrimPrefix(partition, zvolDevice(dataset)+"-"))
+		if err = os.Mkdir(dir, 0755); err != nil {
+			break
+		}
+		if journal.do("mount "+partition+" "+dir,
+			func() error { return runCommand(ctx, "mount", "-o", "ro", partition, dir) },
+			func() error {
+				if err := runCommand(ctx, "umount", dir); err != nil {
+					return err
+				}
+				return os.Remove(dir)
+			}) != nil {
+			os.Remove(dir)
+			continue
+		}
+		mounted = append(mounted, dir)
+	}
+	if err == nil && len(mounted) == 0 {
+		err = fmt.Errorf("none of partitions on %s could be mounted", zvolDevice(dataset))
+	}
+	if err != nil {
+		journal.rollback()
+		return nil, err
+	}
+	return
+}
+
+// Unmount partitions of seat mounted by mountTarget and activate its SCST
+// device. Device is left deactivated when one of partitions is still mounted.
+// Device which is not mounted is not touched. Unmounted mount points are
+// returned
+func unmountTarget(ctx context.Context, scst ScstBackend, journal *stepJournal, root string, deviceid string) (unmounted []string, err error) {
+	var (
+		mounts []string
+	)
+	if mounts, err = targetMounts(root, deviceid); err != nil {
+		return
+	}
+	if len(mounts) == 0 {
+		return nil, fmt.Errorf("%s is not mounted", deviceid)
+	}
+	ctx, cancel := stepsContext(ctx)
+	defer cancel()
+	for _, dir := range mounts {
+		dir := dir
+		if err = journal.do("unmount "+dir,
+			func() error {
+				if err := runCommand(ctx, "umount", dir); err != nil {
+					return err
+				}
+				return os.Remove(dir)
+			},
+			nil); err != nil {
+			return
+		}
+		unmounted = append(unmounted, dir)
+	}
+	deviceDir := filepath.Join(root, deviceid)
+	if err = journal.do("remove "+deviceDir,
+		func() error {
+			if err := os.Remove(filepath.Join(deviceDir, mountDatasetFile)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return os.Remove(deviceDir)
+		},
+		nil); err != nil {
+		return
+	}
+	err = journal.do("activate "+deviceid,
+		func() error { return scst.ActivateDevice(ctx, deviceid) },
+		nil)
+	return
+}
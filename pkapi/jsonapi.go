@@ -1,4 +1,4 @@
-package main
+package pkapi
 
 import (
 	"encoding/json"
@@ -6,44 +6,44 @@ import (
 	"net/http"
 )
 
-type jsonResponseGeneric struct {
+type JsonResponseGeneric struct {
 	Action       string                 `json:"action"`
 	Status       string                 `json:"status"`
 	ErrorMessage string                 `json:"errormessage,omitempty"`
 	Data         map[string]interface{} `json:"data,omitempty"`
 }
 
-type jsonResponseListAll struct {
-	jsonResponseGeneric
+type JsonResponseListAll struct {
+	JsonResponseGeneric
 	ZfsEntities []ZfsEntity `json:"data"`
 }
 
-type jsonResponseList struct {
-	jsonResponseGeneric
+type JsonResponseList struct {
+	JsonResponseGeneric
 	Data []string `json:"data"`
 }
 
-func (j *jsonResponseGeneric) SetAction(action string) {
+func (j *JsonResponseGeneric) SetAction(action string) {
 	j.Action = action
 }
 
-func (j *jsonResponseGeneric) Success() {
+func (j *JsonResponseGeneric) Success() {
 	j.Status = "success"
 }
 
-func (j *jsonResponseGeneric) Error(message string) {
+func (j *JsonResponseGeneric) Error(message string) {
 	j.Status = "error"
 	j.ErrorMessage = message
 }
 
-func (j *jsonResponseGeneric) SetVal(key string, val interface{}) {
+func (j *JsonResponseGeneric) SetVal(key string, val interface{}) {
 	if j.Data == nil {
 		j.Data = make(map[string]interface{})
 	}
 	j.Data[key] = val
 }
 
-func (j *jsonResponseGeneric) GetData() map[string]string {
+func (j *JsonResponseGeneric) GetData() map[string]string {
 	var (
 		res map[string]string = make(map[string]string)
 	)
@@ -55,12 +55,12 @@ func (j *jsonResponseGeneric) GetData() map[string]string {
 	return res
 }
 
-func (j *jsonResponseGeneric) GetVal(key string) (res string) {
+func (j *JsonResponseGeneric) GetVal(key string) (res string) {
 	res = fmt.Sprintf("%v", j.Data[key])
 	return
 }
 
-func (j *jsonResponseGeneric) Write(w *http.ResponseWriter) {
+func (j *JsonResponseGeneric) Write(w *http.ResponseWriter) {
 	enc := json.NewEncoder(*w)
 	enc.SetIndent("", "    ")
 	enc.Encode(j)
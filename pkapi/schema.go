@@ -0,0 +1,203 @@
+package pkapi
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Declared layout of action response. Fields are written in declared order
+// after action, status and errormessage
+type ResponseSchema struct {
+	Fields []string
+	Log    bool
+	Disks  []string
+}
+
+var ResponseSchemas = map[string]ResponseSchema{
+	"snapshot": {
+		Fields: []string{"snapsource", "snapname"},
+		Log:    true,
+	},
+	"bookmark": {
+		Fields: []string{"dataset", "mode", "snapshot", "bookmark"},
+		Log:    true,
+	},
+	"clone": {
+		Fields: []string{"clonesource", "clonename", "snapshot", "volblocksize", "compression", "refreservation", "origin"},
+		Log:    true,
+	},
+	"targetcreate": {
+		Fields: []string{"dataset", "deviceid", "file", "target"},
+		Log:    true,
+	},
+	"targetmount": {
+		Fields: []string{"deviceid", "mode", "dataset", "mounted", "unmounted"},
+		Log:    true,
+	},
+	"targetinfo": {
+		Fields: []string{"tgtid", "target", "enabled"},
+		Log:    true,
+	},
+	"targetconfig": {
+		Fields: []string{"tgtid"},
+		Log:    true,
+	},
+	"targetenable": {
+		Fields: []string{"tgtid"},
+	},
+	"targetdisable": {
+		Fields: []string{"tgtid", "drain", "force", "closed"},
+	},
+	"lastsnapshot": {
+		Fields: []string{"dataset", "lastsnapshot", "creation", "used", "referenced", "clones"},
+	},
+	"rollback": {
+		Fields: []string{"dataset", "snapshot", "deviceid", "recursive", "discarded"},
+		Log:    true,
+	},
+	"diffcreate": {
+		Fields: []string{"clonename", "from", "to", "offset", "limit", "more"},
+		Log:    true,
+	},
+	"destroy": {
+		Fields: []string{"dataset", "deviceid", "recursive", "deferred"},
+		Log:    true,
+	},
+	"replicate": {
+		Fields: []string{"dataset", "peer"},
+		Log:    true,
+	},
+	"send": {
+		Fields: []string{"snapshot", "from", "resumetoken"},
+	},
+	"startreceiving": {
+		Fields: []string{"dataset", "url", "resumable", "background", "jobid", "snapshot", "resumetoken"},
+	},
+	"sendlist": {
+		Log: true,
+	},
+	"receivelist": {
+		Log: true,
+	},
+	"senddetails": {
+		Fields: []string{"id", "kind", "source", "destination", "state", "bytes", "total", "rate", "eta", "started", "finished", "error"},
+	},
+	"receivinglog": {
+		Fields: []string{"id", "state"},
+		Log:    true,
+	},
+	"canceljob": {
+		Fields: []string{"id"},
+	},
+	"status": {
+		Log: true,
+	},
+	"smartclone": {
+		Fields: []string{"clonesource", "clonename", "deviceid", "target", "actualclone", "lastsnapshot", "origin", "written", "dryrun", "plan", "blockedby"},
+		Log:    true,
+	},
+	"smartclone2": {
+		Disks: []string{"desktop", "games"},
+	},
+	"checkclone": {
+		Fields: []string{"actualclone", "lastsnapshot", "origin", "written", "dryrun", "plan", "blockedby"},
+		Log:    true,
+	},
+	"locks": {
+		Log: true,
+	},
+	"seats": {
+		Log: true,
+	},
+	"release": {
+		Fields: []string{"seat", "gamesid", "waited", "duration", "state"},
+		Disks:  []string{"desktop", "games"},
+	},
+	"schema": {
+		Fields: []string{"name"},
+	},
+}
+
+const xsdLog string = `<xs:element name="log" minOccurs="0">
+%[1]s  <xs:complexType>
+%[1]s    <xs:sequence>
+%[1]s      <xs:any processContents="skip" minOccurs="0" maxOccurs="unbounded"/>
+%[1]s    </xs:sequence>
+%[1]s  </xs:complexType>
+%[1]s</xs:element>
+`
+
+const xsdDisk string = `  <xs:complexType name="disk">
+    <xs:sequence>
+      <xs:element name="status" type="status"/>
+      <xs:element name="errormessage" type="xs:string" minOccurs="0"/>
+      <xs:element name="deviceid" type="xs:string"/>
+      <xs:element name="target" type="xs:string"/>
+      <xs:element name="file" type="xs:string"/>
+      <xs:element name="lastsnapshot" type="xs:string"/>
+      <xs:element name="origin" type="xs:string"/>
+      <xs:element name="written" type="xs:string"/>
+      <xs:element name="clonesnapshot" type="xs:string"/>
+      <xs:element name="actualclone" type="xs:string" minOccurs="0"/>
+      <xs:element name="plan" type="xs:string" minOccurs="0"/>
+      <xs:element name="blockedby" type="xs:string" minOccurs="0"/>
+      ` + `<xs:element name="log" minOccurs="0">
+        <xs:complexType>
+          <xs:sequence>
+            <xs:element name="step" minOccurs="0" maxOccurs="unbounded">
+              <xs:complexType>
+                <xs:sequence>
+                  <xs:element name="name" type="xs:string"/>
+                  <xs:element name="state" type="xs:string"/>
+                  <xs:element name="error" type="xs:string" minOccurs="0"/>
+                </xs:sequence>
+              </xs:complexType>
+            </xs:element>
+          </xs:sequence>
+        </xs:complexType>
+      </xs:element>
+    </xs:sequence>
+  </xs:complexType>
+`
+
+// XSD of action response generated from its declared schema
+func (s ResponseSchema) Xsd(action string) string {
+	var (
+		b      strings.Builder
+		indent string = "        "
+	)
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema" elementFormDefault="qualified">
+  <xs:element name="response">
+    <xs:complexType>
+      <xs:sequence>
+`)
+	fmt.Fprintf(&b, "%s<xs:element name=\"action\" type=\"xs:string\" fixed=\"%s\"/>\n", indent, action)
+	fmt.Fprintf(&b, "%s<xs:element name=\"status\" type=\"status\"/>\n", indent)
+	fmt.Fprintf(&b, "%s<xs:element name=\"errormessage\" type=\"xs:string\" minOccurs=\"0\"/>\n", indent)
+	for _, field := range s.Fields {
+		fmt.Fprintf(&b, "%s<xs:element name=\"%s\" type=\"xs:string\" minOccurs=\"0\"/>\n", indent, field)
+	}
+	if s.Log {
+		b.WriteString(indent)
+		fmt.Fprintf(&b, xsdLog, indent)
+	}
+	for _, disk := range s.Disks {
+		fmt.Fprintf(&b, "%s<xs:element name=\"%s\" type=\"disk\" minOccurs=\"0\"/>\n", indent, disk)
+	}
+	b.WriteString(`      </xs:sequence>
+    </xs:complexType>
+  </xs:element>
+  <xs:simpleType name="status">
+    <xs:restriction base="xs:string">
+      <xs:enumeration value="success"/>
+      <xs:enumeration value="error"/>
+    </xs:restriction>
+  </xs:simpleType>
+`)
+	if len(s.Disks) > 0 {
+		b.WriteString(xsdDisk)
+	}
+	b.WriteString("</xs:schema>\n")
+	return b.String()
+}
@@ -0,0 +1,356 @@
+package pkapi
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	formatXml  string = "xml"
+	formatJson string = "json"
+)
+
+// Response writer which knows requested response format
+type formatResponseWriter struct {
+	http.ResponseWriter
+	format string
+}
+
+func (f *formatResponseWriter) Flush() {
+	if flusher, ok := f.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Response format is taken from format query parameter or Accept header.
+// XML is the default
+func responseFormat(r *http.Request) string {
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+	case formatJson:
+		return formatJson
+	case formatXml:
+		return formatXml
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		switch strings.TrimSpace(strings.SplitN(accept, ";", 2)[0]) {
+		case "application/json":
+			return formatJson
+		case "application/xml", "text/xml":
+			return formatXml
+		}
+	}
+	return formatXml
+}
+
+func FormatMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&formatResponseWriter{ResponseWriter: w, format: responseFormat(r)}, r)
+	})
+}
+
+func WantsJson(w http.ResponseWriter) bool {
+	f, ok := w.(*formatResponseWriter)
+	return ok && f.format == formatJson
+}
+
+type XmlApi interface {
+	SetAction(action string)
+	SetVal(name, val string)
+	Success()
+	Error()
+	Write()
+}
+
+func (x *XmlResponseGeneric) SetAction(act string) {
+	x.Action = act
+}
+
+func (x *XmlResponseGeneric) Success() {
+	x.Status = "success"
+}
+
+func (x *XmlResponseGeneric) Error(message string) {
+	x.Status = "error"
+	x.Fields.Set("errormessage", message)
+}
+
+func (x *XmlResponseGeneric) SetVal(name, val string) {
+	x.Fields.Set(name, val)
+}
+
+func (x *XmlResponseGeneric) Write(w *http.ResponseWriter) {
+	x.Fields.order(x.Action)
+	writeResponse(w, x, x.jsonResponse())
+}
+
+// The same response in JSON. Fields go to data as in zfs_api responses
+func (x *XmlResponseGeneric) jsonResponse() *JsonResponseGeneric {
+	var (
+		res JsonResponseGeneric
+	)
+	res.SetAction(x.Action)
+	res.Status = x.Status
+	for _, field := range x.Fields {
+		if field.Name == "errormessage" {
+			res.ErrorMessage = field.Value
+		} else {
+			res.SetVal(field.Name, field.Value)
+		}
+	}
+	return &res
+}
+
+func writeResponse(w *http.ResponseWriter, x interface{}, j *JsonResponseGeneric) {
+	if WantsJson(*w) {
+		(*w).Header().Set("Content-Type", "application/json")
+		j.Write(w)
+		return
+	}
+	fmt.Fprintf(*w, xml.Header)
+	enc := xml.NewEncoder(*w)
+	enc.Indent(" ", "  ")
+	if err := enc.Encode(x); err != nil {
+		log.Println(err.Error())
+	}
+	fmt.Fprintf(*w, "\n")
+}
+
+type XmlData struct {
+	XMLName xml.Name    `xml:"log"`
+	Entries interface{} `xml:"entry"`
+}
+
+// Log entry of decoded response. It is kept as raw XML until it is
+// decoded to concrete type with DecodeEntries
+type XmlRawEntry struct {
+	XMLName xml.Name
+	Inner   []byte `xml:",innerxml"`
+}
+
+// XML Decoder for log. Entry type is not known here so entries are kept raw
+func (d *XmlData) UnmarshalXML(e *xml.Decoder, start xml.StartElement) error {
+	var (
+		raw struct {
+			Entries []XmlRawEntry `xml:",any"`
+		}
+	)
+	if err := e.DecodeElement(&raw, &start); err != nil {
+		return err
+	}
+	d.XMLName = start.Name
+	d.Entries = raw.Entries
+	return nil
+}
+
+// Decode log entries to slice pointed by v, e.g. *[]ZfsEntity
+func (d *XmlData) DecodeEntries(v interface{}) error {
+	var (
+		data []byte
+		err  error
+	)
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		return errors.New("log entries must be decoded to pointer to slice")
+	}
+	raw, ok := d.Entries.([]XmlRawEntry)
+	if !ok {
+		return errors.New("log is not decoded from xml")
+	}
+	slice := rv.Elem()
+	for _, entry := range raw {
+		if data, err = xml.Marshal(entry); err != nil {
+			return err
+		}
+		item := reflect.New(slice.Type().Elem())
+		if err = xml.Unmarshal(data, item.Interface()); err != nil {
+			return err
+		}
+		slice.Set(reflect.Append(slice, item.Elem()))
+	}
+	return nil
+}
+
+type XmlResponseGeneric struct {
+	XMLName xml.Name     `xml:"response"`
+	Action  string       `xml:"action"`
+	Status  string       `xml:"status"`
+	Fields  XmlFieldsMap `xml:",any"`
+}
+
+type XmlStep struct {
+	XMLName xml.Name `xml:"step" json:"-"`
+	Name    string   `xml:"name" json:"name"`
+	State   string   `xml:"state" json:"state"`
+	Error   string   `xml:"error,omitempty" json:"error,omitempty"`
+}
+
+type XmlSC2Disk struct {
+	Status        string    `xml:"status" json:"status"`
+	ErrorMessage  string    `xml:"errormessage,omitempty" json:"errormessage,omitempty"`
+	DeviceId      string    `xml:"deviceid" json:"deviceid"`
+	Target        string    `xml:"target" json:"target"`
+	File          string    `xml:"file" json:"file"`
+	LastSnapshot  string    `xml:"lastsnapshot" json:"lastsnapshot"`
+	Origin        string    `xml:"origin" json:"origin"`
+	Written       string    `xml:"written" json:"written"`
+	CloneSnapshot string    `xml:"clonesnapshot" json:"clonesnapshot"`
+	ActualClone   string    `xml:"actualclone,omitempty" json:"actualclone,omitempty"`
+	Plan          string    `xml:"plan,omitempty" json:"plan,omitempty"`
+	BlockedBy     string    `xml:"blockedby,omitempty" json:"blockedby,omitempty"`
+	Steps         []XmlStep `xml:"log>step" json:"log,omitempty"`
+}
+
+func (d *XmlSC2Disk) Success() {
+	d.Status = "success"
+}
+
+func (d *XmlSC2Disk) Error(message string) {
+	d.Status = "error"
+	d.ErrorMessage = message
+}
+
+type XmlResponseSC2 struct {
+	XmlResponseGeneric
+	Desktop *XmlSC2Disk `xml:"desktop,omitempty"`
+	Games   *XmlSC2Disk `xml:"games,omitempty"`
+}
+
+func (x *XmlResponseSC2) Write(w *http.ResponseWriter) {
+	x.Fields.order(x.Action)
+	j := x.jsonResponse()
+	if x.Desktop != nil {
+		j.SetVal("desktop", x.Desktop)
+	}
+	if x.Games != nil {
+		j.SetVal("games", x.Games)
+	}
+	writeResponse(w, x, j)
+}
+
+type ZfsEntity struct {
+	XMLName    xml.Name `xml:"zfsentity" json:"-"`
+	Name       string   `xml:"name" json:"name"`
+	Used       string   `xml:"used" json:"used"`
+	Avail      string   `xml:"avail" json:"avail"`
+	Refer      string   `xml:"refer" json:"refer"`
+	MountPoint string   `xml:"mountpoint" json:"mountpoint"`
+}
+
+type ZfsXmlResponseListAll struct {
+	XmlResponseGeneric
+	Data []ZfsEntity `xml:"zfsentity"`
+}
+
+func (x *ZfsXmlResponseListAll) Write(w *http.ResponseWriter) {
+	x.Fields.order(x.Action)
+	j := x.jsonResponse()
+	if x.Data != nil {
+		j.SetVal("zfsentity", x.Data)
+	}
+	writeResponse(w, x, j)
+}
+
+type ZfsXmlResponseGeneric struct {
+	XMLName      xml.Name `xml:"response"`
+	Action       string   `xml:"action"`
+	Status       string   `xml:"status"`
+	ErrorMessage string   `xml:"errormessage"`
+}
+type XmlResponse struct {
+	XmlResponseGeneric
+	Log *XmlData
+}
+
+func (x *XmlResponse) Write(w *http.ResponseWriter) {
+	x.Fields.order(x.Action)
+	j := x.jsonResponse()
+	if x.Log != nil {
+		j.SetVal("log", x.Log.Entries)
+	}
+	writeResponse(w, x, j)
+}
+
+type XmlField struct {
+	Name  string
+	Value string
+}
+
+// Response fields in the order they were set
+type XmlFieldsMap []XmlField
+
+func (m XmlFieldsMap) Get(name string) string {
+	for _, field := range m {
+		if field.Name == name {
+			return field.Value
+		}
+	}
+	return ""
+}
+
+func (m *XmlFieldsMap) Set(name, val string) {
+	for i := range *m {
+		if (*m)[i].Name == name {
+			(*m)[i].Value = val
+			return
+		}
+	}
+	*m = append(*m, XmlField{Name: name, Value: val})
+}
+
+// Sort fields as declared in action response schema. Error message goes
+// first, undeclared fields go last in order they were set
+func (m XmlFieldsMap) order(action string) {
+	position := func(name string) int {
+		if name == "errormessage" {
+			return -1
+		}
+		for i, field := range ResponseSchemas[action].Fields {
+			if field == name {
+				return i
+			}
+		}
+		return len(ResponseSchemas[action].Fields)
+	}
+	sort.SliceStable(m, func(i, j int) bool { return position(m[i].Name) < position(m[j].Name) })
+}
+
+type xmlFieldEntry struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+// XML Encoder for fields
+func (m XmlFieldsMap) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	for _, field := range m {
+		if err := e.Encode(xmlFieldEntry{XMLName: xml.Name{Local: field.Name}, Value: field.Value}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// XML Decoder for fields. Called for every element which does not match
+// other response fields. Elements with child elements like disks or log
+// entries are not fields and are skipped
+func (m *XmlFieldsMap) UnmarshalXML(e *xml.Decoder, start xml.StartElement) error {
+	var (
+		field struct {
+			Value string `xml:",chardata"`
+			Inner string `xml:",innerxml"`
+		}
+	)
+	if err := e.DecodeElement(&field, &start); err != nil {
+		return err
+	}
+	if strings.Contains(field.Inner, "<") {
+		return nil
+	}
+	m.Set(start.Name.Local, field.Value)
+	return nil
+}
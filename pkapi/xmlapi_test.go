@@ -0,0 +1,158 @@
+package pkapi
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+var testEntities = []ZfsEntity{
+	{XMLName: xml.Name{Local: "zfsentity"}, Name: "data/kvm/desktop/1", Used: "1G", Avail: "10G", Refer: "1G", MountPoint: "-"},
+	{XMLName: xml.Name{Local: "zfsentity"}, Name: "data/kvm/desktop/1@0", Used: "0B", Avail: "-", Refer: "1G", MountPoint: "-"},
+}
+
+// Response body as it is written to client
+func writeTestResponse(write func(w *http.ResponseWriter)) []byte {
+	rec := httptest.NewRecorder()
+	w := http.ResponseWriter(rec)
+	write(&w)
+	return rec.Body.Bytes()
+}
+
+func TestXmlResponseGenericDecode(t *testing.T) {
+	var (
+		log  XmlResponse
+		sc2  XmlResponseSC2
+		list ZfsXmlResponseListAll
+	)
+	log.SetAction("zfslistsnapshots")
+	log.SetVal("dataset", "data/kvm/desktop/1")
+	log.Log = &XmlData{Entries: testEntities}
+	log.Success()
+	sc2.SetAction("smartclone2")
+	sc2.SetVal("seat", "1")
+	sc2.Desktop = &XmlSC2Disk{DeviceId: "1", Target: "data/kvm/desktop/1", Steps: []XmlStep{{XMLName: xml.Name{Local: "step"}, Name: "clone", State: "done"}}}
+	sc2.Desktop.Success()
+	sc2.Error("games: busy")
+	list.SetAction("zfslistall")
+	list.Data = testEntities
+	list.Success()
+	tests := []struct {
+		name   string
+		body   []byte
+		want   XmlFieldsMap
+		status string
+	}{
+		{
+			name:   "log",
+			body:   writeTestResponse(log.Write),
+			want:   XmlFieldsMap{{Name: "dataset", Value: "data/kvm/desktop/1"}},
+			status: "success",
+		},
+		{
+			name:   "smartclone2 disks",
+			body:   writeTestResponse(sc2.Write),
+			want:   XmlFieldsMap{{Name: "errormessage", Value: "games: busy"}, {Name: "seat", Value: "1"}},
+			status: "error",
+		},
+		{
+			name:   "zfs entities",
+			body:   writeTestResponse(list.Write),
+			status: "success",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				got XmlResponseGeneric
+			)
+			if err := xml.Unmarshal(tt.body, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != tt.status {
+				t.Errorf("status = %q, want %q", got.Status, tt.status)
+			}
+			if !reflect.DeepEqual(got.Fields, tt.want) {
+				t.Errorf("fields = %v, want %v", got.Fields, tt.want)
+			}
+		})
+	}
+}
+
+func TestXmlResponseLogDecode(t *testing.T) {
+	var (
+		res     XmlResponse
+		got     XmlResponse
+		entries []ZfsEntity
+	)
+	res.SetAction("zfslistsnapshots")
+	res.Log = &XmlData{Entries: testEntities}
+	res.Success()
+	if err := xml.Unmarshal(writeTestResponse(res.Write), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Log == nil {
+		t.Fatal("log is not decoded")
+	}
+	if err := got.Log.DecodeEntries(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, testEntities) {
+		t.Errorf("entries = %v, want %v", entries, testEntities)
+	}
+	if len(got.Fields) != 0 {
+		t.Errorf("log is decoded as fields %v", got.Fields)
+	}
+}
+
+func TestXmlResponseSC2Decode(t *testing.T) {
+	var (
+		res XmlResponseSC2
+		got XmlResponseSC2
+	)
+	res.SetAction("smartclone2")
+	res.SetVal("seat", "1")
+	res.Desktop = &XmlSC2Disk{DeviceId: "1", Target: "data/kvm/desktop/1", Steps: []XmlStep{{XMLName: xml.Name{Local: "step"}, Name: "clone", State: "done"}}}
+	res.Desktop.Success()
+	res.Games = &XmlSC2Disk{DeviceId: "101", Target: "data/kvm/games/1"}
+	res.Games.Error("busy")
+	res.Success()
+	if err := xml.Unmarshal(writeTestResponse(res.Write), &got); err != nil {
+		t.Fatal(err)
+	}
+	for _, disk := range []struct {
+		name      string
+		got, want *XmlSC2Disk
+	}{
+		{"desktop", got.Desktop, res.Desktop},
+		{"games", got.Games, res.Games},
+	} {
+		if !reflect.DeepEqual(disk.got, disk.want) {
+			t.Errorf("%s = %+v, want %+v", disk.name, disk.got, disk.want)
+		}
+	}
+	if want := (XmlFieldsMap{{Name: "seat", Value: "1"}}); !reflect.DeepEqual(got.Fields, want) {
+		t.Errorf("fields = %v, want %v", got.Fields, want)
+	}
+}
+
+func TestZfsXmlResponseListAllDecode(t *testing.T) {
+	var (
+		res ZfsXmlResponseListAll
+		got ZfsXmlResponseListAll
+	)
+	res.SetAction("zfslistall")
+	res.Data = testEntities
+	res.Success()
+	if err := xml.Unmarshal(writeTestResponse(res.Write), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Data, testEntities) {
+		t.Errorf("entities = %v, want %v", got.Data, testEntities)
+	}
+	if len(got.Fields) != 0 {
+		t.Errorf("entities are decoded as fields %v", got.Fields)
+	}
+}
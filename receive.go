@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Open send stream of peer. Peer reports errors as api response instead of
+// stream. Resume token is added to url so peer continues interrupted stream.
+// Estimated size of stream is returned when peer reports it
+func peerStream(ctx context.Context, peerUrl string, resumeToken string) (res io.ReadCloser, size int64, err error) {
+	var (
+		u        *url.URL
+		request  *http.Request
+		response *http.Response
+		data     []byte
+		apiError XmlResponseGeneric
+	)
+	if u, err = url.Parse(peerUrl); err != nil {
+		return
+	}
+	if resumeToken != "" {
+		q := u.Query()
+		q.Set("resumetoken", resumeToken)
+		u.RawQuery = q.Encode()
+	}
+	if request, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil); err != nil {
+		return
+	}
+	if response, err = http.DefaultClient.Do(request); err != nil {
+		log.Println(err.Error())
+		return
+	}
+	if response.StatusCode == http.StatusOK && response.Header.Get("Content-Type") == "application/octet-stream" {
+		size, _ = strconv.ParseInt(response.Header.Get(sendSizeHeader), 10, 64)
+		return response.Body, size, nil
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s returned %s", u.Host, response.Status)
+	} else if data, err = ioutil.ReadAll(response.Body); err == nil {
+		if xml.Unmarshal(data, &apiError) == nil && apiError.Fields.Get("errormessage") != "" {
+			err = fmt.Errorf("%s: %s", u.Host, apiError.Fields.Get("errormessage"))
+		} else {
+			err = fmt.Errorf("%s did not return send stream", u.Host)
+		}
+	}
+	log.Println(err.Error())
+	return
+}
+
+// Streams are pulled only from configured peers, peer url must have scheme
+// and host of one of them and lie under its path
+func checkPeerUrl(peers []Peer, peerUrl string) (err error) {
+	var (
+		u    *url.URL
+		peer *url.URL
+	)
+	if u, err = url.Parse(peerUrl); err != nil {
+		return
+	}
+	for _, p := range peers {
+		if peer, err = url.Parse(p.Url); err != nil {
+			return fmt.Errorf("invalid url of peer %s: %s", p.Name, err.Error())
+		}
+		if strings.EqualFold(u.Scheme, peer.Scheme) && strings.EqualFold(u.Host, peer.Host) &&
+			strings.HasPrefix(u.Path, strings.TrimSuffix(peer.Path, "/")) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not an url of configured peer", peerUrl)
+}
+
+// Resume token of interrupted resumable receive into dataset, empty when
+// there is nothing to resume
+func resumeToken(ctx context.Context, zfs ZfsBackend, dataset string) string {
+	var (
+		exists bool
+		props  map[string]string
+		err    error
+	)
+	if exists, err = zfs.CheckDatasetExists(ctx, dataset); err != nil || !exists {
+		return ""
+	}
+	if props, err = zfs.GetProperties(ctx, dataset, []string{"receive_resume_token"}); err != nil {
+		return ""
+	}
+	return props["receive_resume_token"]
+}
+
+// Receive stream from request body or from peer url into dataset. Progress
+// and result are reported to job. Received snapshot is returned. When
+// resumable receive fails its resume token is returned so the stream can be
+// continued
+func receiveStream(ctx context.Context, zfs ZfsBackend, job *Job, dataset string, peerUrl string, body io.Reader, resumable bool) (snapshot string, token string, err error) {
+	var (
+		stream io.ReadCloser
+		size   int64
+	)
+	defer func() { job.Finish(ctx, err) }()
+	if peerUrl != "" {
+		if resumable {
+			if token = resumeToken(ctx, zfs, dataset); token != "" {
+				job.Logf("resuming with token %s", token)
+			}
+		}
+		if stream, size, err = peerStream(ctx, peerUrl, token); err != nil {
+			return
+		}
+		defer stream.Close()
+		job.SetTotal(size)
+		body = stream
+	} else if body == nil {
+		return "", "", errors.New("missing send stream or peer url")
+	}
+	if err = zfs.Receive(ctx, dataset, resumable, job.Reader(body)); err != nil {
+		if resumable {
+			// Partial state is kept even when request is cancelled
+			tokenCtx, cancel := stepsContext(ctx)
+			token = resumeToken(tokenCtx, zfs, dataset)
+			cancel()
+			if token != "" {
+				job.Logf("receive can be resumed with token %s", token)
+			}
+		}
+		return
+	}
+	token = ""
+	if snapshot, err = zfs.GetLastSnapshot(ctx, strings.SplitN(dataset, "@", 2)[0]); err == nil {
+		if snapshot == "" {
+			err = fmt.Errorf("there is no any snapshot in %s", dataset)
+		} else {
+			job.Logf("received %s", snapshot)
+		}
+	}
+	return
+}
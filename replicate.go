@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/Tualua/pk_api_go/client"
+)
+
+type XmlReplica struct {
+	XMLName     xml.Name `xml:"peer" json:"-"`
+	Name        string   `xml:"name" json:"name"`
+	Status      string   `xml:"status" json:"status"`
+	Common      string   `xml:"common,omitempty" json:"common,omitempty"`
+	Snapshot    string   `xml:"snapshot,omitempty" json:"snapshot,omitempty"`
+	ResumeToken string   `xml:"resumetoken,omitempty" json:"resumetoken,omitempty"`
+	Error       string   `xml:"error,omitempty" json:"error,omitempty"`
+}
+
+// Short name of snapshot or bookmark, i.e. part after @ or #
+func shortName(name string) string {
+	if i := strings.IndexAny(name, "@#"); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// Newest local snapshot or bookmark which peer has as snapshot. Snapshots
+// are preferred, bookmarks keep incremental base when snapshot is already
+// destroyed. Both lists are ordered oldest first
+func commonBase(snapshots []string, bookmarks []string, peerSnapshots map[string]bool) string {
+	for _, list := range [][]string{snapshots, bookmarks} {
+		for i := len(list) - 1; i >= 0; i-- {
+			if peerSnapshots[shortName(list[i])] {
+				return list[i]
+			}
+		}
+	}
+	return ""
+}
+
+// Url of send stream on this node. Stream is incremental from common base,
+// with all intermediate snapshots when base is a snapshot
+func replicationUrl(selfUrl string, snapshot string, common string) (string, error) {
+	u, err := url.Parse(selfUrl)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("action", "send")
+	q.Set("snapshot", snapshot)
+	if common != "" {
+		q.Set("from", common)
+		if strings.Contains(common, "@") {
+			q.Set("intermediate", "1")
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Make peer pull increment of dataset from this node up to lastSnapshot and
+// check that peer has it afterwards
+func replicateToPeer(ctx context.Context, selfUrl string, peer Peer, dataset string, lastSnapshot string, snapshots []string, bookmarks []string) (res XmlReplica) {
+	var (
+		c             *client.Client
+		entities      []ZfsEntity
+		peerHasData   bool
+		peerSnapshots map[string]bool = make(map[string]bool)
+		sendUrl       string
+		last          client.LastSnapshotResult
+		err           error
+	)
+	res.Name = peer.Name
+	defer func() {
+		if err != nil {
+			res.Status = "error"
+			res.Error = err.Error()
+		} else {
+			res.Status = "success"
+		}
+	}()
+	if c, err = client.New(peer.Url, 0); err != nil {
+		return
+	}
+	if entities, err = c.Status(ctx); err != nil {
+		return
+	}
+	for _, entity := range entities {
+		if entity.Name == dataset {
+			peerHasData = true
+		} else if strings.HasPrefix(entity.Name, dataset+"@") {
+			peerSnapshots[shortName(entity.Name)] = true
+		}
+	}
+	if peerSnapshots[shortName(lastSnapshot)] {
+		res.Common = lastSnapshot
+		res.Snapshot = dataset + "@" + shortName(lastSnapshot)
+		return
+	}
+	if res.Common = commonBase(snapshots, bookmarks, peerSnapshots); res.Common == "" && peerHasData {
+		err = fmt.Errorf("%s has no common snapshot with %s", dataset, peer.Name)
+		return
+	}
+	if sendUrl, err = replicationUrl(selfUrl, lastSnapshot, res.Common); err != nil {
+		return
+	}
+	if _, res.ResumeToken, err = c.StartReceiving(ctx, dataset, sendUrl, true); err != nil {
+		return
+	}
+	if last, err = c.LastSnapshot(ctx, dataset); err != nil {
+		return
+	}
+	res.Snapshot = last.LastSnapshot
+	if shortName(last.LastSnapshot) != shortName(lastSnapshot) {
+		err = fmt.Errorf("last snapshot of %s is %s, expected %s", peer.Name, last.LastSnapshot, shortName(lastSnapshot))
+	}
+	return
+}
+
+// Replicate dataset to peers. Peers are processed one by one, failed peer
+// does not stop the others
+func replicate(ctx context.Context, zfs ZfsBackend, selfUrl string, peers []Peer, dataset string) (res []XmlReplica, err error) {
+	var (
+		lastSnapshot string
+		snapshots    []string
+		bookmarks    []string
+		failed       []string
+	)
+	if selfUrl == "" {
+		return nil, fmt.Errorf("server url is not configured")
+	}
+	if lastSnapshot, err = zfs.GetLastSnapshot(ctx, dataset); err != nil {
+		return
+	}
+	if lastSnapshot == "" {
+		return nil, fmt.Errorf("there is no any snapshot in %s", dataset)
+	}
+	if snapshots, err = zfs.ListSnapshots(ctx, dataset); err != nil {
+		return
+	}
+	if bookmarks, err = zfs.ListBookmarks(ctx, dataset); err != nil {
+		return
+	}
+	for _, peer := range peers {
+		replica := replicateToPeer(ctx, selfUrl, peer, dataset, lastSnapshot, snapshots, bookmarks)
+		if replica.Status != "success" {
+			failed = append(failed, peer.Name)
+		}
+		res = append(res, replica)
+	}
+	if len(failed) > 0 {
+		err = fmt.Errorf("replication failed for: %s", strings.Join(failed, ", "))
+	}
+	return
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Snapshots created after the given one, they are discarded by rollback
+func laterSnapshots(ctx context.Context, zfs ZfsBackend, snapshot string) (res []string, err error) {
+	var (
+		snapshots []string
+	)
+	dataset := strings.SplitN(snapshot, "@", 2)[0]
+	if snapshots, err = zfs.ListSnapshots(ctx, dataset); err != nil {
+		return
+	}
+	for i, name := range snapshots {
+		if name == snapshot {
+			return snapshots[i+1:], nil
+		}
+	}
+	return nil, fmt.Errorf("there is no snapshot %s", snapshot)
+}
+
+// Roll dataset back to snapshot. Later snapshots are destroyed only with
+// recursive, otherwise rollback is refused. When deviceid is given the device
+// is checked for iSCSI sessions and deactivated for the time of rollback,
+// otherwise devices backed by zvol of dataset are looked up and checked.
+// Discarded snapshots are returned
+func rollbackDataset(ctx context.Context, zfs ZfsBackend, scst ScstBackend, journal *stepJournal, snapshot string, deviceid string, recursive bool) (discarded []string, err error) {
+	if discarded, err = laterSnapshots(ctx, zfs, snapshot); err != nil {
+		return
+	}
+	if len(discarded) > 0 && !recursive {
+		return nil, fmt.Errorf("more recent snapshots exist: %s", strings.Join(discarded, ","))
+	}
+	if deviceid != "" {
+		err = ScstCheckIscsiSessions(ctx, scst, deviceid)
+	} else {
+		// Recursive rollback destroys later snapshots, children are not touched
+		err = checkDatasetDevices(ctx, zfs, scst, "rollback", strings.SplitN(snapshot, "@", 2)[0], nil, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := stepsContext(ctx)
+	defer cancel()
+	if deviceid != "" {
+		if err = journal.do("deactivate "+deviceid,
+			func() error { return scst.DeactivateDevice(ctx, deviceid) },
+			func() error { return scst.ActivateDevice(ctx, deviceid) }); err != nil {
+			return nil, err
+		}
+	}
+	// Failed rollback leaves dataset untouched so there is nothing to undo
+	if err = journal.do("rollback "+snapshot,
+		func() error { return zfs.Rollback(ctx, snapshot, recursive) },
+		nil); err != nil {
+		journal.rollback()
+		return nil, err
+	}
+	if deviceid != "" {
+		if err = journal.do("activate "+deviceid,
+			func() error { return scst.ActivateDevice(ctx, deviceid) },
+			nil); err != nil {
+			journal.broken("deactivate "+deviceid, "device is still deactivated")
+			err = fmt.Errorf("%s, broken steps: %s", err.Error(), strings.Join(journal.brokenSteps(), ", "))
+		}
+	}
+	return
+}
@@ -1,23 +1,104 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"strconv"
 )
 
-func scstGetIscsiSessions(apiScst string, tgtid string) (res []string, err error) {
+const SCST_SYSFS_ROOT string = "/sys/kernel/scst_tgt"
+
+// Prefix of generated iSCSI target names, device id is appended to it
+const SCST_IQN_PREFIX string = "iqn.2021-01.local.pkapi"
+
+// SCST operations used by API handlers. Implemented by scstApiBackend which
+// calls remote scst_api and scstSysfsBackend which works with SCST sysfs tree
+type ScstBackend interface {
+	IscsiSessions(ctx context.Context, tgtid string) ([]string, error)
+	DeactivateDevice(ctx context.Context, devid string) error
+	ActivateDevice(ctx context.Context, devid string) error
+	IscsiTargetParams(ctx context.Context, tgtid string) (map[string]string, error)
+	AddBlockioDevice(ctx context.Context, devid string, filename string) error
+	DeleteDevice(ctx context.Context, devid string) error
+	AddIscsiTarget(ctx context.Context, iqn string) error
+	DeleteIscsiTarget(ctx context.Context, iqn string) error
+	AddLun(ctx context.Context, iqn string, lun int, devid string) error
+	SetTargetEnabled(ctx context.Context, tgtid string, enabled bool) error
+	CloseIscsiSessions(ctx context.Context, tgtid string) error
+	IscsiTargetInfo(ctx context.Context, tgtid string) (ScstTarget, error)
+	SetIscsiTargetParam(ctx context.Context, tgtid string, name string, value string) error
+	DevicesByFile(ctx context.Context, filename string, children bool) ([]string, error)
+}
+
+// Returned by backend for operations its remote api does not provide
+var errNotSupported = errors.New("not supported by api backend")
+
+// iSCSI target with its LUN mappings, initiator ACLs and live sessions.
+// Params are target attributes like MaxRecvDataSegmentLength
+type ScstTarget struct {
+	Name     string            `json:"name"`
+	Enabled  bool              `json:"enabled"`
+	Luns     []ScstLun         `json:"luns"`
+	Acls     []ScstAcl         `json:"acls"`
+	Sessions []ScstSession     `json:"sessions"`
+	Params   map[string]string `json:"params"`
+}
+
+// Device mapped to target LUN, Filename is path of backing device
+type ScstLun struct {
+	Lun      string `json:"lun"`
+	Device   string `json:"device"`
+	Filename string `json:"filename"`
+}
+
+// Initiator allowed to access target through initiator group
+type ScstAcl struct {
+	Group     string `json:"group"`
+	Initiator string `json:"initiator"`
+}
+
+// Session of initiator, one address per connection
+type ScstSession struct {
+	Initiator string   `json:"initiator"`
+	Addresses []string `json:"addresses"`
+}
+
+type jsonResponseTarget struct {
+	jsonResponseGeneric
+	Data ScstTarget `json:"data"`
+}
+
+func NewScstBackend(cfg *Config) (ScstBackend, error) {
+	switch cfg.Scst.Backend {
+	case "", "api":
+		client, err := NewApiClient(cfg.Apis.ScstApi, cfg.Apis.Timeout, cfg.Apis.Retries, cfg.Apis.Backoff)
+		if err != nil {
+			return nil, err
+		}
+		return &scstApiBackend{client: client}, nil
+	case "sysfs":
+		root := cfg.Scst.SysfsRoot
+		if root == "" {
+			root = SCST_SYSFS_ROOT
+		}
+		return &scstSysfsBackend{root: root}, nil
+	}
+	return nil, fmt.Errorf("unknown scst backend: %s", cfg.Scst.Backend)
+}
+
+type scstApiBackend struct {
+	client *ApiClient
+}
+
+func (s *scstApiBackend) IscsiSessions(ctx context.Context, tgtid string) (res []string, err error) {
 	var (
-		apiResponse []byte
-		param       map[string]string = make(map[string]string)
-		jsonData    jsonResponseList
+		param    map[string]string = make(map[string]string)
+		jsonData jsonResponseList
 	)
 	param["tgtid"] = tgtid
-	if apiResponse, err = apiCall(apiScst, "iscsisessions", param); err != nil {
-		log.Println(err.Error())
-	} else {
-		json.Unmarshal(apiResponse, &jsonData)
+	if err = s.client.Call(ctx, "iscsisessions", param, true, &jsonData); err == nil {
 		if jsonData.Status != "error" {
 			res = jsonData.Data
 		} else {
@@ -27,11 +108,11 @@ func scstGetIscsiSessions(apiScst string, tgtid string) (res []string, err error
 	return
 }
 
-func ScstCheckIscsiSessions(apiScst string, tgtid string) (err error) {
+func ScstCheckIscsiSessions(ctx context.Context, scst ScstBackend, tgtid string) (err error) {
 	var (
 		res []string
 	)
-	if res, err = scstGetIscsiSessions(apiScst, tgtid); err != nil {
+	if res, err = scst.IscsiSessions(ctx, tgtid); err != nil {
 		log.Println(err.Error())
 	} else {
 		if len(res) > 0 {
@@ -41,17 +122,13 @@ func ScstCheckIscsiSessions(apiScst string, tgtid string) (err error) {
 	return
 }
 
-func ScstDeactivateDevice(apiScst string, devid string) (err error) {
+func (s *scstApiBackend) DeactivateDevice(ctx context.Context, devid string) (err error) {
 	var (
-		apiResponse []byte
-		param       map[string]string = make(map[string]string)
-		jsonData    jsonResponseGeneric
+		param    map[string]string = make(map[string]string)
+		jsonData jsonResponseGeneric
 	)
 	param["devid"] = devid
-	if apiResponse, err = apiCall(apiScst, "deactdev", param); err != nil {
-		log.Println(err.Error())
-	} else {
-		json.Unmarshal(apiResponse, &jsonData)
+	if err = s.client.Call(ctx, "deactdev", param, false, &jsonData); err == nil {
 		if jsonData.Status == "error" {
 			err = errors.New(jsonData.ErrorMessage)
 		}
@@ -59,17 +136,13 @@ func ScstDeactivateDevice(apiScst string, devid string) (err error) {
 	return
 }
 
-func ScstActivateDevice(apiScst string, devid string) (err error) {
+func (s *scstApiBackend) ActivateDevice(ctx context.Context, devid string) (err error) {
 	var (
-		apiResponse []byte
-		param       map[string]string = make(map[string]string)
-		jsonData    jsonResponseGeneric
+		param    map[string]string = make(map[string]string)
+		jsonData jsonResponseGeneric
 	)
 	param["devid"] = devid
-	if apiResponse, err = apiCall(apiScst, "actdev", param); err != nil {
-		log.Println(err.Error())
-	} else {
-		json.Unmarshal(apiResponse, &jsonData)
+	if err = s.client.Call(ctx, "actdev", param, false, &jsonData); err == nil {
 		if jsonData.Status == "error" {
 			err = errors.New(jsonData.ErrorMessage)
 		}
@@ -77,17 +150,13 @@ func ScstActivateDevice(apiScst string, devid string) (err error) {
 	return
 }
 
-func ScstGetIscsiTargetParams(apiScst string, tgtid string) (res map[string]string, err error) {
+func (s *scstApiBackend) IscsiTargetParams(ctx context.Context, tgtid string) (res map[string]string, err error) {
 	var (
-		apiResponse []byte
-		param       map[string]string = make(map[string]string)
-		jsonData    jsonResponseGeneric
+		param    map[string]string = make(map[string]string)
+		jsonData jsonResponseGeneric
 	)
 	param["tgtid"] = tgtid
-	if apiResponse, err = apiCall(apiScst, "iscsitargetparams", param); err != nil {
-		log.Println(err.Error())
-	} else {
-		json.Unmarshal(apiResponse, &jsonData)
+	if err = s.client.Call(ctx, "iscsitargetparams", param, true, &jsonData); err == nil {
 		if jsonData.Status == "error" {
 			err = errors.New(jsonData.ErrorMessage)
 		} else {
@@ -96,3 +165,74 @@ func ScstGetIscsiTargetParams(apiScst string, tgtid string) (res map[string]stri
 	}
 	return
 }
+
+// Call scst_api action which only reports success or error
+func (s *scstApiBackend) call(ctx context.Context, command string, param map[string]string) (err error) {
+	var (
+		jsonData jsonResponseGeneric
+	)
+	if err = s.client.Call(ctx, command, param, false, &jsonData); err == nil {
+		if jsonData.Status == "error" {
+			err = errors.New(jsonData.ErrorMessage)
+		}
+	}
+	return
+}
+
+func (s *scstApiBackend) AddBlockioDevice(ctx context.Context, devid string, filename string) error {
+	return s.call(ctx, "adddev", map[string]string{"devid": devid, "filename": filename})
+}
+
+func (s *scstApiBackend) DeleteDevice(ctx context.Context, devid string) error {
+	return s.call(ctx, "deldev", map[string]string{"devid": devid})
+}
+
+func (s *scstApiBackend) AddIscsiTarget(ctx context.Context, iqn string) error {
+	return s.call(ctx, "addtarget", map[string]string{"tgtid": iqn})
+}
+
+func (s *scstApiBackend) DeleteIscsiTarget(ctx context.Context, iqn string) error {
+	return s.call(ctx, "deltarget", map[string]string{"tgtid": iqn})
+}
+
+func (s *scstApiBackend) AddLun(ctx context.Context, iqn string, lun int, devid string) error {
+	return s.call(ctx, "addlun", map[string]string{"tgtid": iqn, "lun": strconv.Itoa(lun), "devid": devid})
+}
+
+func (s *scstApiBackend) SetTargetEnabled(ctx context.Context, tgtid string, enabled bool) error {
+	if enabled {
+		return s.call(ctx, "enabletarget", map[string]string{"tgtid": tgtid})
+	}
+	return s.call(ctx, "disabletarget", map[string]string{"tgtid": tgtid})
+}
+
+func (s *scstApiBackend) CloseIscsiSessions(ctx context.Context, tgtid string) error {
+	return s.call(ctx, "closesessions", map[string]string{"tgtid": tgtid})
+}
+
+func (s *scstApiBackend) IscsiTargetInfo(ctx context.Context, tgtid string) (res ScstTarget, err error) {
+	var (
+		param    map[string]string = make(map[string]string)
+		jsonData jsonResponseTarget
+	)
+	param["tgtid"] = tgtid
+	if err = s.client.Call(ctx, "iscsitargetinfo", param, true, &jsonData); err == nil {
+		if jsonData.Status == "error" {
+			err = errors.New(jsonData.ErrorMessage)
+		} else if jsonData.Data.Name == "" {
+			err = fmt.Errorf("there is no iscsi target for %s", tgtid)
+		} else {
+			res = jsonData.Data
+		}
+	}
+	return
+}
+
+func (s *scstApiBackend) SetIscsiTargetParam(ctx context.Context, tgtid string, name string, value string) error {
+	return s.call(ctx, "settargetparam", map[string]string{"tgtid": tgtid, "name": name, "value": value})
+}
+
+// There is no way to list devices with their backing files in scst_api
+func (s *scstApiBackend) DevicesByFile(ctx context.Context, filename string, children bool) ([]string, error) {
+	return nil, fmt.Errorf("device lookup is %w", errNotSupported)
+}
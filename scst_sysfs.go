@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SCST backend working with SCST sysfs tree on the storage node itself.
+// Target id is either iSCSI target name or id of device mapped to the target
+type scstSysfsBackend struct {
+	root string
+}
+
+func (s *scstSysfsBackend) iscsiTargetsPath() string {
+	return filepath.Join(s.root, "targets", "iscsi")
+}
+
+func (s *scstSysfsBackend) devicePath(devid string) string {
+	return filepath.Join(s.root, "devices", devid)
+}
+
+// Read sysfs attribute. Value is the first line, the rest is service
+// information like [key] mark
+func (s *scstSysfsBackend) readAttr(path string) (res string, err error) {
+	var (
+		data []byte
+	)
+	if data, err = ioutil.ReadFile(path); err != nil {
+		log.Println(err.Error())
+	} else {
+		res = strings.SplitN(string(data), "\n", 2)[0]
+	}
+	return
+}
+
+func (s *scstSysfsBackend) writeAttr(path string, val string) (err error) {
+	if err = ioutil.WriteFile(path, []byte(val+"\n"), 0644); err != nil {
+		log.Println(err.Error())
+	}
+	return
+}
+
+// Names of subdirectories, sysfs attributes are skipped
+func (s *scstSysfsBackend) listDirs(path string) (res []string, err error) {
+	var (
+		entries []os.FileInfo
+	)
+	if entries, err = ioutil.ReadDir(path); err != nil {
+		log.Println(err.Error())
+	} else {
+		for _, entry := range entries {
+			if entry.IsDir() {
+				res = append(res, entry.Name())
+			}
+		}
+		sort.Strings(res)
+	}
+	return
+}
+
+// Names of readable attributes, subdirectories and write-only attributes
+// like mgmt are skipped
+func (s *scstSysfsBackend) listAttrs(path string) (res []string, err error) {
+	var (
+		entries []os.FileInfo
+	)
+	if entries, err = ioutil.ReadDir(path); err != nil {
+		log.Println(err.Error())
+	} else {
+		for _, entry := range entries {
+			if entry.Mode().IsRegular() && entry.Mode().Perm()&0444 != 0 {
+				res = append(res, entry.Name())
+			}
+		}
+		sort.Strings(res)
+	}
+	return
+}
+
+// Find iSCSI target by its name or by device mapped to one of its LUNs
+func (s *scstSysfsBackend) findTarget(tgtid string) (res string, err error) {
+	var (
+		targets []string
+		luns    []string
+		link    string
+	)
+	if tgtid == "" {
+		return "", errors.New("missing target id")
+	}
+	if info, statErr := os.Stat(filepath.Join(s.iscsiTargetsPath(), tgtid)); statErr == nil && info.IsDir() {
+		return tgtid, nil
+	}
+	if targets, err = s.listDirs(s.iscsiTargetsPath()); err != nil {
+		return
+	}
+	for _, target := range targets {
+		lunsPath := filepath.Join(s.iscsiTargetsPath(), target, "luns")
+		if luns, err = s.listDirs(lunsPath); err != nil {
+			return
+		}
+		for _, lun := range luns {
+			if link, err = os.Readlink(filepath.Join(lunsPath, lun, "device")); err != nil {
+				log.Println(err.Error())
+				continue
+			}
+			if filepath.Base(link) == tgtid {
+				return target, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("there is no iscsi target for %s", tgtid)
+}
+
+func (s *scstSysfsBackend) IscsiSessions(ctx context.Context, tgtid string) (res []string, err error) {
+	var (
+		target string
+	)
+	if target, err = s.findTarget(tgtid); err == nil {
+		res, err = s.listDirs(filepath.Join(s.iscsiTargetsPath(), target, "sessions"))
+	}
+	return
+}
+
+func (s *scstSysfsBackend) setDeviceActive(devid string, active string) (err error) {
+	if devid == "" {
+		err = errors.New("missing device id")
+	} else if _, err = os.Stat(s.devicePath(devid)); err != nil {
+		err = fmt.Errorf("there is no device %s", devid)
+	} else {
+		err = s.writeAttr(filepath.Join(s.devicePath(devid), "active"), active)
+	}
+	return
+}
+
+func (s *scstSysfsBackend) DeactivateDevice(ctx context.Context, devid string) error {
+	return s.setDeviceActive(devid, "0")
+}
+
+func (s *scstSysfsBackend) ActivateDevice(ctx context.Context, devid string) error {
+	return s.setDeviceActive(devid, "1")
+}
+
+// Target attributes. Target name is returned as wwn
+func (s *scstSysfsBackend) IscsiTargetParams(ctx context.Context, tgtid string) (res map[string]string, err error) {
+	var (
+		target string
+		attrs  []string
+		val    string
+	)
+	if target, err = s.findTarget(tgtid); err != nil {
+		return
+	}
+	targetPath := filepath.Join(s.iscsiTargetsPath(), target)
+	if attrs, err = s.listAttrs(targetPath); err != nil {
+		return
+	}
+	res = make(map[string]string)
+	for _, attr := range attrs {
+		if val, err = s.readAttr(filepath.Join(targetPath, attr)); err != nil {
+			return
+		}
+		res[attr] = val
+	}
+	res["wwn"] = target
+	return
+}
+
+func (s *scstSysfsBackend) AddBlockioDevice(ctx context.Context, devid string, filename string) error {
+	return s.writeAttr(filepath.Join(s.root, "handlers", "vdisk_blockio", "mgmt"),
+		fmt.Sprintf("add_device %s filename=%s", devid, filename))
+}
+
+// Device is removed by its handler, handler is found by handler link
+func (s *scstSysfsBackend) DeleteDevice(ctx context.Context, devid string) (err error) {
+	var (
+		link string
+	)
+	if link, err = os.Readlink(filepath.Join(s.devicePath(devid), "handler")); err != nil {
+		log.Println(err.Error())
+		return
+	}
+	return s.writeAttr(filepath.Join(s.root, "handlers", filepath.Base(link), "mgmt"), "del_device "+devid)
+}
+
+func (s *scstSysfsBackend) AddIscsiTarget(ctx context.Context, iqn string) error {
+	return s.writeAttr(filepath.Join(s.iscsiTargetsPath(), "mgmt"), "add_target "+iqn)
+}
+
+func (s *scstSysfsBackend) DeleteIscsiTarget(ctx context.Context, iqn string) error {
+	return s.writeAttr(filepath.Join(s.iscsiTargetsPath(), "mgmt"), "del_target "+iqn)
+}
+
+func (s *scstSysfsBackend) AddLun(ctx context.Context, iqn string, lun int, devid string) error {
+	return s.writeAttr(filepath.Join(s.iscsiTargetsPath(), iqn, "luns", "mgmt"), fmt.Sprintf("add %s %d", devid, lun))
+}
+
+func (s *scstSysfsBackend) SetTargetEnabled(ctx context.Context, tgtid string, enabled bool) (err error) {
+	var (
+		target string
+	)
+	if target, err = s.findTarget(tgtid); err == nil {
+		if enabled {
+			err = s.writeAttr(filepath.Join(s.iscsiTargetsPath(), target, "enabled"), "1")
+		} else {
+			err = s.writeAttr(filepath.Join(s.iscsiTargetsPath(), target, "enabled"), "0")
+		}
+	}
+	return
+}
+
+// Sessions are closed with their force_close attribute
+func (s *scstSysfsBackend) CloseIscsiSessions(ctx context.Context, tgtid string) (err error) {
+	var (
+		target   string
+		sessions []string
+	)
+	if target, err = s.findTarget(tgtid); err != nil {
+		return
+	}
+	sessionsPath := filepath.Join(s.iscsiTargetsPath(), target, "sessions")
+	if sessions, err = s.listDirs(sessionsPath); err != nil {
+		return
+	}
+	for _, session := range sessions {
+		if err = s.writeAttr(filepath.Join(sessionsPath, session, "force_close"), "1"); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Target state collected from its sysfs directory. LUN devices are resolved
+// by device links, ACLs are initiators of target initiator groups and
+// session addresses are names of connection directories
+func (s *scstSysfsBackend) IscsiTargetInfo(ctx context.Context, tgtid string) (res ScstTarget, err error) {
+	var (
+		luns       []string
+		groups     []string
+		initiators []string
+		sessions   []string
+		addresses  []string
+		link       string
+		filename   string
+	)
+	if res.Params, err = s.IscsiTargetParams(ctx, tgtid); err != nil {
+		return
+	}
+	res.Name = res.Params["wwn"]
+	delete(res.Params, "wwn")
+	res.Enabled = res.Params["enabled"] == "1"
+	targetPath := filepath.Join(s.iscsiTargetsPath(), res.Name)
+	lunsPath := filepath.Join(targetPath, "luns")
+	if luns, err = s.listDirs(lunsPath); err != nil {
+		return
+	}
+	for _, lun := range luns {
+		if link, err = os.Readlink(filepath.Join(lunsPath, lun, "device")); err != nil {
+			log.Println(err.Error())
+			return
+		}
+		device := filepath.Base(link)
+		// Only vdisk devices have backing file
+		filename, _ = s.readAttr(filepath.Join(s.devicePath(device), "filename"))
+		res.Luns = append(res.Luns, ScstLun{Lun: lun, Device: device, Filename: filename})
+	}
+	groupsPath := filepath.Join(targetPath, "ini_groups")
+	if _, statErr := os.Stat(groupsPath); statErr == nil {
+		if groups, err = s.listDirs(groupsPath); err != nil {
+			return
+		}
+	}
+	for _, group := range groups {
+		if initiators, err = s.listAttrs(filepath.Join(groupsPath, group, "initiators")); err != nil {
+			return
+		}
+		for _, initiator := range initiators {
+			res.Acls = append(res.Acls, ScstAcl{Group: group, Initiator: initiator})
+		}
+	}
+	sessionsPath := filepath.Join(targetPath, "sessions")
+	if sessions, err = s.listDirs(sessionsPath); err != nil {
+		return
+	}
+	for _, session := range sessions {
+		if addresses, err = s.listDirs(filepath.Join(sessionsPath, session)); err != nil {
+			return
+		}
+		res.Sessions = append(res.Sessions, ScstSession{Initiator: session, Addresses: addresses})
+	}
+	return
+}
+
+func (s *scstSysfsBackend) SetIscsiTargetParam(ctx context.Context, tgtid string, name string, value string) (err error) {
+	var (
+		target string
+	)
+	if target, err = s.findTarget(tgtid); err != nil {
+		return
+	}
+	attrPath := filepath.Join(s.iscsiTargetsPath(), target, name)
+	if _, err = os.Stat(attrPath); err != nil {
+		return fmt.Errorf("target %s has no parameter %s", target, name)
+	}
+	return s.writeAttr(attrPath, value)
+}
+
+// Devices backed by filename, with children devices backed by files under
+// filename/ are returned too. Devices without filename attribute are skipped
+func (s *scstSysfsBackend) DevicesByFile(ctx context.Context, filename string, children bool) (res []string, err error) {
+	var (
+		entries []os.FileInfo
+		value   string
+	)
+	if entries, err = ioutil.ReadDir(filepath.Join(s.root, "devices")); err != nil {
+		log.Println(err.Error())
+		return
+	}
+	for _, entry := range entries {
+		attrPath := filepath.Join(s.devicePath(entry.Name()), "filename")
+		if _, statErr := os.Stat(attrPath); statErr != nil {
+			continue
+		}
+		if value, err = s.readAttr(attrPath); err != nil {
+			return
+		}
+		if value == filename || (children && strings.HasPrefix(value, filename+"/")) {
+			res = append(res, entry.Name())
+		}
+	}
+	return
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testIqn string = "iqn.2021-01.local.pkapi:seat1"
+
+// Fake SCST sysfs tree with two vdisk devices. Device 1 is LUN 0 of target
+// seat1 which has one session with one connection, device 2 is not mapped
+func fakeSysfs(t *testing.T) *scstSysfsBackend {
+	t.Helper()
+	root := t.TempDir()
+	target := filepath.Join(root, "targets", "iscsi", testIqn)
+	for _, dir := range []string{
+		filepath.Join(root, "devices", "1"),
+		filepath.Join(root, "devices", "2"),
+		filepath.Join(target, "luns", "0"),
+		filepath.Join(target, "sessions", "iqn.1991-05.com.microsoft:pc1", "10.0.0.5"),
+	} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for path, content := range map[string]string{
+		filepath.Join(root, "devices", "1", "active"):   "1\n",
+		filepath.Join(root, "devices", "2", "active"):   "1\n",
+		filepath.Join(root, "devices", "1", "filename"): "/dev/zvol/data/kvm/desktop/1\n",
+		filepath.Join(root, "devices", "2", "filename"): "/dev/zvol/data/kvm/desktop/10\n",
+		filepath.Join(target, "enabled"):                "1\n",
+		filepath.Join(target, "rel_tgt_id"):             "1\n[key]\n",
+	} {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Management files are write-only like in real sysfs
+	for _, path := range []string{
+		filepath.Join(root, "targets", "iscsi", "mgmt"),
+		filepath.Join(target, "luns", "mgmt"),
+	} {
+		if err := ioutil.WriteFile(path, nil, 0200); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("../../../../../devices/1", filepath.Join(target, "luns", "0", "device")); err != nil {
+		t.Fatal(err)
+	}
+	return &scstSysfsBackend{root: root}
+}
+
+func readTestAttr(t *testing.T, path string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSysfsFindTarget(t *testing.T) {
+	s := fakeSysfs(t)
+	tests := []struct {
+		name    string
+		tgtid   string
+		want    string
+		wantErr bool
+	}{
+		{name: "by iqn", tgtid: testIqn, want: testIqn},
+		{name: "by lun device", tgtid: "1", want: testIqn},
+		{name: "unmapped device", tgtid: "2", wantErr: true},
+		{name: "unknown", tgtid: "iqn.2021-01.local.pkapi:none", wantErr: true},
+		{name: "empty", tgtid: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.findTarget(tt.tgtid)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSysfsSetDeviceActive(t *testing.T) {
+	s := fakeSysfs(t)
+	ctx := context.Background()
+	active := filepath.Join(s.devicePath("1"), "active")
+	if err := s.DeactivateDevice(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestAttr(t, active); got != "0\n" {
+		t.Errorf("active after deactivate = %q", got)
+	}
+	if err := s.ActivateDevice(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestAttr(t, active); got != "1\n" {
+		t.Errorf("active after activate = %q", got)
+	}
+	for _, devid := range []string{"", "3"} {
+		if err := s.DeactivateDevice(ctx, devid); err == nil {
+			t.Errorf("deactivate %q did not fail", devid)
+		}
+	}
+	if _, err := os.Stat(s.devicePath("3")); !os.IsNotExist(err) {
+		t.Errorf("missing device was created")
+	}
+}
+
+func TestSysfsIscsiSessions(t *testing.T) {
+	s := fakeSysfs(t)
+	want := []string{"iqn.1991-05.com.microsoft:pc1"}
+	for _, tgtid := range []string{testIqn, "1"} {
+		got, err := s.IscsiSessions(context.Background(), tgtid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("sessions of %s = %v, want %v", tgtid, got, want)
+		}
+	}
+	if _, err := s.IscsiSessions(context.Background(), "2"); err == nil {
+		t.Error("sessions of unmapped device did not fail")
+	}
+}
+
+func TestSysfsCloseIscsiSessions(t *testing.T) {
+	s := fakeSysfs(t)
+	if err := s.CloseIscsiSessions(context.Background(), "1"); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(s.iscsiTargetsPath(), testIqn, "sessions", "iqn.1991-05.com.microsoft:pc1", "force_close")
+	if got := readTestAttr(t, path); got != "1\n" {
+		t.Errorf("force_close = %q, want %q", got, "1\n")
+	}
+}
+
+func TestSysfsListAttrs(t *testing.T) {
+	s := fakeSysfs(t)
+	got, err := s.listAttrs(filepath.Join(s.iscsiTargetsPath(), testIqn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// luns and sessions are directories, mgmt is write-only
+	if want := []string{"enabled", "rel_tgt_id"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, _ = s.listAttrs(filepath.Join(s.iscsiTargetsPath(), testIqn, "luns")); len(got) != 0 {
+		t.Errorf("luns attributes = %v, mgmt is not skipped", got)
+	}
+}
+
+func TestSysfsDevicesByFile(t *testing.T) {
+	s := fakeSysfs(t)
+	// Device without backing file like a pass-through one
+	if err := os.MkdirAll(s.devicePath("sg0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		filename string
+		children bool
+		want     []string
+	}{
+		{name: "exact", filename: "/dev/zvol/data/kvm/desktop/1", want: []string{"1"}},
+		{name: "not a prefix", filename: "/dev/zvol/data/kvm/desktop/1", children: true, want: []string{"1"}},
+		{name: "children", filename: "/dev/zvol/data/kvm/desktop", children: true, want: []string{"1", "2"}},
+		{name: "parent only", filename: "/dev/zvol/data/kvm/desktop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.DevicesByFile(context.Background(), tt.filename, tt.children)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	seatUnknown   string = "unknown"
+	seatBusy      string = "busy"
+	seatReleasing string = "releasing"
+	seatFree      string = "free"
+	seatFailed    string = "failed"
+)
+
+// Time to wait for iSCSI sessions of seat to log out on release
+const SEAT_RELEASE_DRAIN time.Duration = 60 * time.Second
+
+type XmlSeat struct {
+	XMLName  xml.Name `xml:"seat" json:"-"`
+	Id       string   `xml:"id" json:"id"`
+	GamesId  string   `xml:"gamesid" json:"gamesid"`
+	State    string   `xml:"state" json:"state"`
+	Changed  string   `xml:"changed,omitempty" json:"changed,omitempty"`
+	Duration string   `xml:"duration,omitempty" json:"duration,omitempty"`
+	Error    string   `xml:"error,omitempty" json:"error,omitempty"`
+}
+
+type seatEntry struct {
+	seat     Seat
+	state    string
+	changed  time.Time
+	duration time.Duration
+	err      string
+}
+
+// Seats configured on this node and their state. Release moves seat through
+// releasing to free or failed. Whether seat is busy or free is observed from
+// live state of its disks when seats are listed. Recorded state is kept in
+// memory only, after restart it is derived again
+type SeatInventory struct {
+	mu    sync.Mutex
+	seats map[string]*seatEntry
+}
+
+func NewSeatInventory(seats []Seat) *SeatInventory {
+	m := &SeatInventory{seats: make(map[string]*seatEntry)}
+	for _, seat := range seats {
+		m.seats[seat.Id] = &seatEntry{seat: seat, state: seatUnknown}
+	}
+	return m
+}
+
+func (m *SeatInventory) Get(id string) (Seat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if entry, ok := m.seats[id]; ok {
+		return entry.seat, nil
+	}
+	return Seat{}, fmt.Errorf("there is no seat %s", id)
+}
+
+// Set state of seat. Duration of reset is kept until the next release,
+// err is cleared with any state except failed
+func (m *SeatInventory) SetState(id string, state string, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if entry, ok := m.seats[id]; ok {
+		entry.state = state
+		entry.changed = time.Now()
+		if duration > 0 {
+			entry.duration = duration
+		}
+		entry.err = ""
+		if err != nil {
+			entry.err = err.Error()
+		}
+	}
+}
+
+// Record state observed from disks of seat. Seats being released or failed
+// to release keep their state until the next release
+func (m *SeatInventory) Observe(id string, state string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if entry, ok := m.seats[id]; ok && entry.state != state && entry.state != seatReleasing && entry.state != seatFailed {
+		entry.state = state
+		entry.changed = time.Now()
+		entry.err = ""
+	}
+}
+
+func (m *SeatInventory) List() []XmlSeat {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]XmlSeat, 0, len(m.seats))
+	for _, entry := range m.seats {
+		seat := XmlSeat{
+			Id:      entry.seat.Id,
+			GamesId: entry.seat.GamesId,
+			State:   entry.state,
+			Error:   entry.err,
+		}
+		if !entry.changed.IsZero() {
+			seat.Changed = entry.changed.Format(time.RFC3339)
+		}
+		if entry.duration > 0 {
+			seat.Duration = seconds(entry.duration)
+		}
+		res = append(res, seat)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Id < res[j].Id })
+	return res
+}
+
+// Duration in seconds with millisecond precision
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// Wait until iSCSI sessions of all devices log out but not longer than
+// timeout in total
+func drainSeat(ctx context.Context, scst ScstBackend, deviceids []string, timeout time.Duration) (err error) {
+	var (
+		sessions []string
+	)
+	deadline := time.Now().Add(timeout)
+	for _, deviceid := range deviceids {
+		wait := time.Until(deadline)
+		if wait < 0 {
+			wait = 0
+		}
+		if sessions, err = drainTarget(ctx, scst, deviceid, wait); err != nil {
+			return
+		}
+		if len(sessions) > 0 {
+			return fmt.Errorf("iscsi sessions of %s did not log out in %s: %s", deviceid, timeout, strings.Join(sessions, ","))
+		}
+	}
+	return
+}
+
+// State of seat derived from its disks. Seat is busy while iSCSI sessions
+// of its disks are open or when its disks were written since they were reset
+// to @0, otherwise it is free
+func seatLiveState(ctx context.Context, zfs ZfsBackend, scst ScstBackend, prefixes ClonePrefixes, seat Seat) (state string, err error) {
+	var (
+		sessions  []string
+		cloneinfo map[string]string
+	)
+	for _, deviceid := range []string{seat.Id, seat.GamesId} {
+		if sessions, err = scst.IscsiSessions(ctx, deviceid); err != nil {
+			return
+		}
+		if len(sessions) > 0 {
+			return seatBusy, nil
+		}
+	}
+	for _, clonename := range []string{prefixes.System + seat.Id, prefixes.Games + seat.GamesId} {
+		if cloneinfo, err = zfs.GetCloneInfo(ctx, clonename); err != nil {
+			return
+		}
+		switch cloneinfo["written"] {
+		case "":
+			return "", fmt.Errorf("can not get written of %s", clonename)
+		case "0":
+		default:
+			return seatBusy, nil
+		}
+	}
+	return seatFree, nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Headers of send stream with its estimated size in bytes and id of job
+// tracking it
+const (
+	sendSizeHeader string = "X-Send-Size"
+	jobIdHeader    string = "X-Job-Id"
+)
+
+// Writer of send stream. Headers are written with the first chunk of stream
+// so failure before it is still reported as api response
+type sendStreamWriter struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (s *sendStreamWriter) Write(p []byte) (int, error) {
+	if !s.started {
+		s.w.Header().Set("Content-Type", "application/octet-stream")
+		s.started = true
+	}
+	return s.w.Write(p)
+}
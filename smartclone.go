@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	stepDone    string = "done"
+	stepFailed  string = "failed"
+	stepUndone  string = "undone"
+	stepBroken  string = "broken"
+	stepPlanned string = "planned"
+)
+
+const (
+	planNothing  string = "nothing"
+	planRollback string = "rollback"
+	planReclone  string = "reclone"
+)
+
+type SmartCloneInfo struct {
+	origin        string
+	written       string
+	lastsnapshot  string
+	actualclone   string
+	clonesnapshot string
+	steps         []XmlStep
+
+	plan           string
+	sessions       []string
+	zerosnapexists bool
+}
+
+// Default time limit of modifying steps started by one request including undo
+const STEPS_TIMEOUT time.Duration = 5 * time.Minute
+
+var stepsTimeout time.Duration = STEPS_TIMEOUT
+
+// Context which keeps values of its parent but is never cancelled with it
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (deadline time.Time, ok bool) { return }
+func (detachedContext) Done() <-chan struct{}                   { return nil }
+func (detachedContext) Err() error                              { return nil }
+
+// Context of modifying steps. Once started, steps and their undo must not be
+// interrupted by cancelled request, they are bounded by stepsTimeout instead
+func stepsContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(detachedContext{ctx}, stepsTimeout)
+}
+
+type journalStep struct {
+	XmlStep
+	undo func() error
+}
+
+// Journal of modifying steps. Every step carries an undo action which is
+// executed in reverse order when one of the following steps fails.
+// Journal in dryrun mode only records planned steps
+type stepJournal struct {
+	steps  []*journalStep
+	dryrun bool
+}
+
+func (j *stepJournal) do(name string, action func() error, undo func() error) (err error) {
+	step := &journalStep{XmlStep: XmlStep{Name: name}, undo: undo}
+	j.steps = append(j.steps, step)
+	if j.dryrun {
+		step.State = stepPlanned
+	} else if err = action(); err != nil {
+		log.Println(err.Error())
+		step.State = stepFailed
+		step.Error = err.Error()
+	} else {
+		step.State = stepDone
+	}
+	return
+}
+
+// Mark completed step as broken, i.e. its effect is still in place
+// but the whole operation did not finish
+func (j *stepJournal) broken(name string, reason string) {
+	for _, step := range j.steps {
+		if step.Name == name && step.State == stepDone {
+			step.State = stepBroken
+			step.Error = reason
+		}
+	}
+}
+
+func (j *stepJournal) rollback() {
+	for i := len(j.steps) - 1; i >= 0; i-- {
+		step := j.steps[i]
+		if step.State != stepDone {
+			continue
+		}
+		if step.undo == nil {
+			step.State = stepBroken
+			step.Error = "step can not be undone"
+		} else if err := step.undo(); err != nil {
+			log.Println(err.Error())
+			step.State = stepBroken
+			step.Error = err.Error()
+		} else {
+			step.State = stepUndone
+		}
+	}
+}
+
+func (j *stepJournal) brokenSteps() (res []string) {
+	for _, step := range j.steps {
+		if step.State == stepBroken {
+			res = append(res, step.Name)
+		}
+	}
+	return
+}
+
+func (j *stepJournal) Steps() []XmlStep {
+	res := make([]XmlStep, 0, len(j.steps))
+	for _, step := range j.steps {
+		res = append(res, step.XmlStep)
+	}
+	return res
+}
+
+// Plan how clone is going to be reset. Only read-only checks are done here:
+// last snapshot of clone source, clone origin, @0 snapshot and iSCSI sessions
+func planSmartClone(ctx context.Context, zfs ZfsBackend, scst ScstBackend, clonename string, clonesource string, deviceid string) (res SmartCloneInfo, err error) {
+	var (
+		lastSnapshot string
+		cloneinfo    map[string]string = make(map[string]string)
+	)
+	if lastSnapshot, err = zfs.GetLastSnapshot(ctx, clonesource); err != nil {
+		fmt.Println(err.Error())
+	} else {
+		if lastSnapshot == "" {
+			err = fmt.Errorf("there is no any snapshot in %s", clonesource)
+		} else {
+			res.lastsnapshot = lastSnapshot
+			if cloneinfo, err = zfs.GetCloneInfo(ctx, clonename); err != nil {
+				fmt.Println(err.Error())
+			} else {
+				// Check if dataset is clone
+				if cloneinfo["origin"] == "" {
+					err = fmt.Errorf("%s is not clone", clonename)
+				} else {
+					res.origin = cloneinfo["origin"]
+					res.written = cloneinfo["written"]
+					// Check if clone is modified or is not on last snapshot
+					if cloneinfo["written"] != "0" || cloneinfo["origin"] != lastSnapshot {
+						if res.zerosnapexists, err = zfs.CheckDatasetExists(ctx, clonename+"@0"); err != nil {
+							fmt.Println(err.Error())
+						} else {
+							if cloneinfo["origin"] == lastSnapshot && res.zerosnapexists {
+								res.plan = planRollback
+							} else {
+								res.plan = planReclone
+							}
+							// Check if there are any established iSCSI session
+							if deviceid != "" {
+								if res.sessions, err = scst.IscsiSessions(ctx, deviceid); err != nil {
+									fmt.Println(err.Error())
+								}
+							}
+						}
+					} else {
+						res.plan = planNothing
+						res.actualclone = "nothing to do"
+					}
+				}
+			}
+		}
+	}
+	return
+}
+
+// Reset clone to the last snapshot of clone source. Either rollbacks clone to
+// its @0 snapshot or recreates it from the newer snapshot. All modifying steps
+// are journaled and undone if any of them fails. With dryrun steps are only
+// planned and nothing is changed
+func smartClone(ctx context.Context, zfs ZfsBackend, scst ScstBackend, clonename string, clonesource string, deviceid string, dryrun bool) (res SmartCloneInfo, err error) {
+	var (
+		journal stepJournal = stepJournal{dryrun: dryrun}
+	)
+	defer func() {
+		res.steps = journal.Steps()
+	}()
+	if res, err = planSmartClone(ctx, zfs, scst, clonename, clonesource, deviceid); err == nil && res.plan != planNothing {
+		if len(res.sessions) > 0 && !dryrun {
+			err = fmt.Errorf("there is an active iscsi session: %s", res.sessions[0])
+		} else {
+			if err = smartCloneReset(ctx, &journal, zfs, scst, clonename, clonesource, deviceid, res); err != nil {
+				if broken := journal.brokenSteps(); len(broken) > 0 {
+					err = fmt.Errorf("%s, broken steps: %s", err.Error(), strings.Join(broken, ", "))
+				}
+			} else if !dryrun {
+				res.clonesnapshot = clonename + "@0"
+			}
+		}
+	}
+	return
+}
+
+// Modifying part of smartClone. Device is deactivated, then clone is either
+// rolled back to @0 or destroyed and cloned from the last snapshot of clone source
+func smartCloneReset(ctx context.Context, journal *stepJournal, zfs ZfsBackend, scst ScstBackend, clonename string, clonesource string, deviceid string,
+	info SmartCloneInfo) (err error) {
+	ctx, cancel := stepsContext(ctx)
+	defer cancel()
+	zeroSnapshot := clonename + "@0"
+	// Deactivate device to make it avaliable for modifications
+	if err = journal.do("deactivate "+deviceid,
+		func() error { return scst.DeactivateDevice(ctx, deviceid) },
+		func() error { return scst.ActivateDevice(ctx, deviceid) }); err != nil {
+		return
+	}
+	if info.plan == planRollback {
+		// Failed rollback leaves dataset untouched so there is nothing to undo
+		err = journal.do("rollback "+zeroSnapshot,
+			func() error { return zfs.Rollback(ctx, zeroSnapshot, false) },
+			nil)
+	} else {
+		err = journal.do("destroy "+clonename,
+			func() error { return zfs.Destroy(ctx, clonename) },
+			func() (err error) {
+				// Clone data is lost but seat gets back the dataset it had
+				if err = zfs.Clone(ctx, info.origin, clonename, nil); err == nil && info.zerosnapexists {
+					err = zfs.CreateSnapshot(ctx, clonename, "0")
+				}
+				return
+			})
+		if err == nil {
+			err = journal.do("clone "+clonesource+" "+clonename,
+				func() error { return zfs.CloneLast(ctx, clonename, clonesource, nil) },
+				func() error { return zfs.Destroy(ctx, clonename) })
+		}
+		if err == nil {
+			err = journal.do("snapshot "+zeroSnapshot,
+				func() error { return zfs.CreateSnapshot(ctx, clonename, "0") },
+				func() error { return zfs.Destroy(ctx, zeroSnapshot) })
+		}
+	}
+	if err != nil {
+		journal.rollback()
+		return
+	}
+	// Dataset is already in its final state so failed activation is not undone,
+	// device just stays deactivated
+	if err = journal.do("activate "+deviceid,
+		func() error { return scst.ActivateDevice(ctx, deviceid) },
+		nil); err != nil {
+		journal.broken("deactivate "+deviceid, "device is still deactivated")
+	}
+	return
+}
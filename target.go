@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entries of targetinfo log. Entry kind is the element name in XML and type
+// in JSON
+type XmlTargetLun struct {
+	XMLName  xml.Name `xml:"lun" json:"-"`
+	Type     string   `xml:"-" json:"type"`
+	Id       string   `xml:"id" json:"id"`
+	Device   string   `xml:"device" json:"device"`
+	Filename string   `xml:"filename" json:"filename"`
+}
+
+type XmlTargetAcl struct {
+	XMLName   xml.Name `xml:"acl" json:"-"`
+	Type      string   `xml:"-" json:"type"`
+	Group     string   `xml:"group" json:"group"`
+	Initiator string   `xml:"initiator" json:"initiator"`
+}
+
+type XmlTargetSession struct {
+	XMLName   xml.Name `xml:"session" json:"-"`
+	Type      string   `xml:"-" json:"type"`
+	Initiator string   `xml:"initiator" json:"initiator"`
+	Addresses []string `xml:"address" json:"addresses"`
+}
+
+type XmlTargetParam struct {
+	XMLName xml.Name `xml:"param" json:"-"`
+	Type    string   `xml:"-" json:"type"`
+	Name    string   `xml:"name" json:"name"`
+	Value   string   `xml:"value" json:"value"`
+}
+
+// Tunable iSCSI target parameter. Numeric parameter is limited by min and
+// max, the others accept one of values
+type targetParam struct {
+	min    int
+	max    int
+	values []string
+}
+
+// Parameters which targetconfig changes. Limits of negotiated parameters
+// are from RFC 7143, QueuedCommands is limited by iscsi-scst
+var targetParams = map[string]targetParam{
+	"MaxRecvDataSegmentLength": {min: 512, max: 16777215},
+	"MaxXmitDataSegmentLength": {min: 512, max: 16777215},
+	"FirstBurstLength":         {min: 512, max: 16777215},
+	"MaxBurstLength":           {min: 512, max: 16777215},
+	"MaxOutstandingR2T":        {min: 1, max: 65535},
+	"QueuedCommands":           {min: 1, max: 2048},
+	"InitialR2T":               {values: []string{"Yes", "No"}},
+	"ImmediateData":            {values: []string{"Yes", "No"}},
+	"HeaderDigest":             {values: []string{"None", "CRC32C", "CRC32C,None", "None,CRC32C"}},
+	"DataDigest":               {values: []string{"None", "CRC32C", "CRC32C,None", "None,CRC32C"}},
+}
+
+// Block device of zvol
+func zvolDevice(dataset string) string {
+	return "/dev/zvol/" + dataset
+}
+
+// Create vdisk_blockio device for zvol of dataset, iSCSI target with the
+// device as LUN 0 and enable the target. Created objects are removed when
+// one of steps fails
+func createTarget(ctx context.Context, zfs ZfsBackend, scst ScstBackend, journal *stepJournal, dataset string, devid string, iqn string) (err error) {
+	var (
+		exists bool
+	)
+	if exists, err = zfs.CheckDatasetExists(ctx, dataset); err != nil {
+		return
+	} else if !exists {
+		return fmt.Errorf("there is no dataset %s", dataset)
+	}
+	ctx, cancel := stepsContext(ctx)
+	defer cancel()
+	if err = journal.do("add device "+devid,
+		func() error { return scst.AddBlockioDevice(ctx, devid, zvolDevice(dataset)) },
+		func() error { return scst.DeleteDevice(ctx, devid) }); err == nil {
+		err = journal.do("add target "+iqn,
+			func() error { return scst.AddIscsiTarget(ctx, iqn) },
+			func() error { return scst.DeleteIscsiTarget(ctx, iqn) })
+	}
+	if err == nil {
+		// LUN is removed together with its target
+		err = journal.do("add lun 0 "+devid,
+			func() error { return scst.AddLun(ctx, iqn, 0, devid) },
+			func() error { return nil })
+	}
+	if err == nil {
+		err = journal.do("enable "+iqn,
+			func() error { return scst.SetTargetEnabled(ctx, iqn, true) },
+			func() error { return scst.SetTargetEnabled(ctx, iqn, false) })
+	}
+	if err != nil {
+		journal.rollback()
+	}
+	return
+}
+
+// Interval of checking iSCSI sessions while target is drained
+const TARGET_DRAIN_POLL time.Duration = time.Second
+
+// Wait until all iSCSI sessions of target log out but not longer than
+// timeout. Remaining sessions are returned
+func drainTarget(ctx context.Context, scst ScstBackend, tgtid string, timeout time.Duration) (sessions []string, err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if sessions, err = scst.IscsiSessions(ctx, tgtid); err != nil || len(sessions) == 0 {
+			return
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return
+		}
+		if wait > TARGET_DRAIN_POLL {
+			wait = TARGET_DRAIN_POLL
+		}
+		select {
+		case <-ctx.Done():
+			return sessions, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Disable target. Target with active sessions is only disabled with drain
+// or force. Drain waits for sessions to log out, force closes sessions which
+// are still there. Target is enabled back when drained sessions did not log
+// out and force is not set. Closed sessions are returned
+func disableTarget(ctx context.Context, scst ScstBackend, tgtid string, drain time.Duration, force bool) (closed []string, err error) {
+	var (
+		sessions []string
+	)
+	if drain == 0 && !force {
+		if err = ScstCheckIscsiSessions(ctx, scst, tgtid); err != nil {
+			return
+		}
+	}
+	if err = scst.SetTargetEnabled(ctx, tgtid, false); err != nil {
+		return
+	}
+	if sessions, err = drainTarget(ctx, scst, tgtid, drain); err != nil || len(sessions) == 0 {
+		return
+	}
+	if !force {
+		err = fmt.Errorf("iscsi sessions did not log out in %s: %s", drain, strings.Join(sessions, ","))
+		enableCtx, cancel := stepsContext(ctx)
+		defer cancel()
+		if enableErr := scst.SetTargetEnabled(enableCtx, tgtid, true); enableErr != nil {
+			err = fmt.Errorf("%s, target is left disabled: %s", err.Error(), enableErr.Error())
+		}
+		return
+	}
+	if err = scst.CloseIscsiSessions(ctx, tgtid); err == nil {
+		closed = sessions
+	}
+	return
+}
+
+// Lock keys of target. Target named by iSCSI name is locked by devices of
+// its LUNs too, so it conflicts with requests locking the same devices by id
+func targetLocks(ctx context.Context, scst ScstBackend, tgtid string) (keys []string, err error) {
+	var (
+		target ScstTarget
+		seen   map[string]bool = map[string]bool{tgtid: true}
+	)
+	if target, err = scst.IscsiTargetInfo(ctx, tgtid); err != nil {
+		return
+	}
+	keys = append(keys, deviceLock(tgtid))
+	for _, lun := range target.Luns {
+		if !seen[lun.Device] {
+			seen[lun.Device] = true
+			keys = append(keys, deviceLock(lun.Device))
+		}
+	}
+	return
+}
+
+// Log entries of targetinfo: LUNs, ACLs, sessions and parameters sorted by
+// name
+func targetInfoEntries(target ScstTarget) (res []interface{}) {
+	var (
+		names []string
+	)
+	for _, lun := range target.Luns {
+		res = append(res, XmlTargetLun{Type: "lun", Id: lun.Lun, Device: lun.Device, Filename: lun.Filename})
+	}
+	for _, acl := range target.Acls {
+		res = append(res, XmlTargetAcl{Type: "acl", Group: acl.Group, Initiator: acl.Initiator})
+	}
+	for _, session := range target.Sessions {
+		res = append(res, XmlTargetSession{Type: "session", Initiator: session.Initiator, Addresses: session.Addresses})
+	}
+	for name := range target.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		res = append(res, XmlTargetParam{Type: "param", Name: name, Value: target.Params[name]})
+	}
+	return
+}
+
+func validateTargetParam(name string, value string) error {
+	param, ok := targetParams[name]
+	if !ok {
+		return fmt.Errorf("unknown target parameter %s", name)
+	}
+	if param.values != nil {
+		for _, v := range param.values {
+			if v == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid %s value: %s, expected one of %s", name, value, strings.Join(param.values, " "))
+	}
+	if n, err := strconv.Atoi(value); err != nil || n < param.min || n > param.max {
+		return fmt.Errorf("invalid %s value: %s, expected number from %d to %d", name, value, param.min, param.max)
+	}
+	return nil
+}
+
+// Change target parameters. All values are validated before the first one
+// is written, already changed parameters are restored when one of them fails
+func configureTarget(ctx context.Context, scst ScstBackend, journal *stepJournal, tgtid string, params map[string]string) (err error) {
+	var (
+		current map[string]string
+		names   []string
+	)
+	if len(params) == 0 {
+		return fmt.Errorf("missing target parameters, supported are: %s", strings.Join(supportedTargetParams(), " "))
+	}
+	for name, value := range params {
+		if err = validateTargetParam(name, value); err != nil {
+			return
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if current, err = scst.IscsiTargetParams(ctx, tgtid); err != nil {
+		return
+	}
+	ctx, cancel := stepsContext(ctx)
+	defer cancel()
+	for _, name := range names {
+		name, value := name, params[name]
+		// Parameter without known value can not be restored
+		var undo func() error
+		if old, ok := current[name]; ok {
+			undo = func() error { return scst.SetIscsiTargetParam(ctx, tgtid, name, old) }
+		}
+		if err = journal.do(fmt.Sprintf("set %s=%s", name, value),
+			func() error { return scst.SetIscsiTargetParam(ctx, tgtid, name, value) },
+			undo); err != nil {
+			journal.rollback()
+			return
+		}
+	}
+	return
+}
+
+func supportedTargetParams() (res []string) {
+	for name := range targetParams {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return
+}
@@ -1,87 +1,112 @@
 package main
 
 import (
-	"encoding/json"
-	"encoding/xml"
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
-	"net/http"
-	"net/url"
+	"os/exec"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 const ZFS_BINARY string = "/sbin/zfs"
 
-type ZfsEntity struct {
-	XMLName    xml.Name `xml:"zfsentity"`
-	Name       string   `xml:"name"`
-	Used       string   `xml:"used"`
-	Avail      string   `xml:"avail"`
-	Refer      string   `xml:"refer"`
-	MountPoint string   `xml:"mountpoint"`
+// Storage operations used by API handlers. Implemented by zfsApiBackend
+// which calls remote zfs_api and zfsLocalBackend which runs zfs binary
+type ZfsBackend interface {
+	ListAll(ctx context.Context) ([]ZfsEntity, error)
+	GetLastSnapshot(ctx context.Context, dataset string) (string, error)
+	ListSnapshots(ctx context.Context, dataset string) ([]string, error)
+	GetCloneInfo(ctx context.Context, dataset string) (map[string]string, error)
+	GetProperties(ctx context.Context, dataset string, props []string) (map[string]string, error)
+	CreateSnapshot(ctx context.Context, snapsource string, snapname string) error
+	CreateBookmark(ctx context.Context, snapshot string, bookmark string) error
+	ListBookmarks(ctx context.Context, dataset string) ([]string, error)
+	DestroyBookmark(ctx context.Context, bookmark string) error
+	Rollback(ctx context.Context, snapshot string, recursive bool) error
+	Destroy(ctx context.Context, dataset string) error
+	DestroyDataset(ctx context.Context, dataset string, opts ZfsDestroyOptions) ([]string, error)
+	GetClones(ctx context.Context, dataset string, recursive bool) ([]string, error)
+	Clone(ctx context.Context, snapshot string, dataset string, props map[string]string) error
+	CloneLast(ctx context.Context, dataset string, origin string, props map[string]string) error
+	CheckDatasetExists(ctx context.Context, dataset string) (bool, error)
+	Send(ctx context.Context, opts ZfsSendOptions, w io.Writer) error
+	SendSize(ctx context.Context, opts ZfsSendOptions) (int64, error)
+	Receive(ctx context.Context, dataset string, resumable bool, r io.Reader) error
+	Diff(ctx context.Context, from string, to string, offset int, limit int) ([]XmlDiffEntry, bool, error)
 }
 
-func apiCall(api string, command string, param map[string]string) ([]byte, error) {
-	var (
-		err          error
-		response     *http.Response
-		responseData []byte
-		res          []byte
-	)
+// Options of destroy action. Recursive destroys snapshots and children,
+// deferred marks snapshots for destruction when they are released
+type ZfsDestroyOptions struct {
+	Recursive bool
+	Deferred  bool
+}
 
-	u, _ := url.Parse(api)
-	q := u.Query()
-	q.Set("action", command)
-	for k := range param {
-		q.Set(k, param[k])
-	}
-	u.RawQuery = q.Encode()
-	apiUrl := u.String()
-	if response, err = http.Get(apiUrl); err != nil {
-		res = []byte(err.Error())
-		log.Println(err.Error())
-	} else {
-		if responseData, err = ioutil.ReadAll(response.Body); err != nil {
-			fmt.Println(err.Error())
-		} else {
-			res = responseData
+// Options of send stream. Stream is incremental from snapshot or bookmark
+// when From is set, with Intermediate all snapshots between them are sent.
+// Interrupted stream is resumed with ResumeToken instead of snapshot
+type ZfsSendOptions struct {
+	Snapshot     string
+	From         string
+	Intermediate bool
+	Compressed   bool
+	Raw          bool
+	ResumeToken  string
+}
+
+func NewZfsBackend(cfg *Config) (ZfsBackend, error) {
+	switch cfg.Zfs.Backend {
+	case "", "api":
+		client, err := NewApiClient(cfg.Apis.ZfsApi, cfg.Apis.Timeout, cfg.Apis.Retries, cfg.Apis.Backoff)
+		if err != nil {
+			return nil, err
+		}
+		return &zfsApiBackend{client: client}, nil
+	case "local":
+		binary := cfg.Zfs.Binary
+		if binary == "" {
+			// zfs on PATH goes first, e.g. fake zfs in tests
+			if path, err := exec.LookPath("zfs"); err == nil {
+				binary = path
+			} else {
+				binary = ZFS_BINARY
+			}
 		}
+		return &zfsLocalBackend{binary: binary}, nil
 	}
-	return res, err
+	return nil, fmt.Errorf("unknown zfs backend: %s", cfg.Zfs.Backend)
 }
 
-func ZfsListAll(apiZfs string) ([]ZfsEntity, error) {
+type zfsApiBackend struct {
+	client *ApiClient
+}
+
+func (z *zfsApiBackend) ListAll(ctx context.Context) ([]ZfsEntity, error) {
 	var (
-		apiResponse []byte
-		err         error
-		res         []ZfsEntity
-		jsonData    jsonResponseListAll
+		err      error
+		res      []ZfsEntity
+		jsonData jsonResponseListAll
 	)
-	if apiResponse, err = apiCall(apiZfs, "listall", nil); err != nil {
-		log.Println(err.Error())
-	} else {
-		json.Unmarshal(apiResponse, &jsonData)
+	if err = z.client.Call(ctx, "listall", nil, true, &jsonData); err == nil {
 		res = jsonData.ZfsEntities
 	}
 	return res, err
 }
 
-func ZfsGetLastSnapshot(apiZfs string, dataset string) (string, error) {
+func (z *zfsApiBackend) GetLastSnapshot(ctx context.Context, dataset string) (string, error) {
 	var (
-		apiResponse []byte
-		err         error
-		res         string
-		param       map[string]string = make(map[string]string)
-		jsonData    jsonResponseGeneric
+		err      error
+		res      string
+		param    map[string]string = make(map[string]string)
+		jsonData jsonResponseGeneric
 	)
 	param["dataset"] = dataset
 
-	if apiResponse, err = apiCall(apiZfs, "lastsnapshot", param); err != nil {
-		log.Println(err.Error())
-	} else {
-		json.Unmarshal(apiResponse, &jsonData)
+	if err = z.client.Call(ctx, "lastsnapshot", param, true, &jsonData); err == nil {
 		if jsonData.Status != "error" {
 			res = fmt.Sprintf("%v", jsonData.Data["lastsnapshot"])
 		} else {
@@ -91,38 +116,63 @@ func ZfsGetLastSnapshot(apiZfs string, dataset string) (string, error) {
 	return res, err
 }
 
-func ZfsGetCloneInfo(apiZfs string, dataset string) (res map[string]string, err error) {
+// Snapshots of dataset in order they are listed by zfs_api, i.e. oldest first
+func (z *zfsApiBackend) ListSnapshots(ctx context.Context, dataset string) (res []string, err error) {
+	var (
+		entities []ZfsEntity
+	)
+	if entities, err = z.ListAll(ctx); err == nil {
+		for _, entity := range entities {
+			if strings.HasPrefix(entity.Name, dataset+"@") {
+				res = append(res, entity.Name)
+			}
+		}
+	}
+	return
+}
+
+func (z *zfsApiBackend) GetCloneInfo(ctx context.Context, dataset string) (res map[string]string, err error) {
 	var (
-		apiResponse []byte
 		// err         error
 		param    map[string]string = make(map[string]string)
 		jsonData jsonResponseGeneric
 		// res         map[string]string = make(map[string]string)
 	)
 	param["dataset"] = dataset
-	if apiResponse, err = apiCall(apiZfs, "cloneinfo", param); err != nil {
-		log.Println(err.Error())
-	} else {
-		json.Unmarshal(apiResponse, &jsonData)
+	if err = z.client.Call(ctx, "cloneinfo", param, true, &jsonData); err == nil {
 		res = jsonData.GetData()
 	}
 	return
 }
 
-func ZfsCreateSnapshot(apiZfs string, snapsource string, snapname string) error {
+// Parsable values of properties, i.e. sizes in bytes and times in seconds
+func (z *zfsApiBackend) GetProperties(ctx context.Context, dataset string, props []string) (res map[string]string, err error) {
+	var (
+		param    map[string]string = make(map[string]string)
+		jsonData jsonResponseGeneric
+	)
+	param["dataset"] = dataset
+	param["properties"] = strings.Join(props, ",")
+	if err = z.client.Call(ctx, "properties", param, true, &jsonData); err == nil {
+		if jsonData.Status == "error" {
+			err = errors.New(jsonData.ErrorMessage)
+		} else {
+			res = jsonData.GetData()
+		}
+	}
+	return
+}
+
+func (z *zfsApiBackend) CreateSnapshot(ctx context.Context, snapsource string, snapname string) error {
 	var (
-		err         error
-		apiResponse []byte
-		res         jsonResponseGeneric
+		err error
+		res jsonResponseGeneric
 	)
 
 	param := make(map[string]string)
 	param["snapsource"] = snapsource
 	param["snapname"] = snapname
-	if apiResponse, err = apiCall(apiZfs, "snapshot", param); err != nil {
-		log.Println(res.ErrorMessage)
-	} else {
-		json.Unmarshal(apiResponse, &res)
+	if err = z.client.Call(ctx, "snapshot", param, false, &res); err == nil {
 		if res.Status == "error" {
 			err = errors.New(res.ErrorMessage)
 		}
@@ -131,18 +181,54 @@ func ZfsCreateSnapshot(apiZfs string, snapsource string, snapname string) error
 	return err
 }
 
-func ZfsRollback(apiZfs string, snapshot string) (err error) {
+func (z *zfsApiBackend) CreateBookmark(ctx context.Context, snapshot string, bookmark string) (err error) {
+	var (
+		param    map[string]string = make(map[string]string)
+		jsonData jsonResponseGeneric
+	)
+	param["snapshot"] = snapshot
+	param["bookmark"] = bookmark
+	if err = z.client.Call(ctx, "bookmark", param, false, &jsonData); err == nil {
+		if jsonData.Status == "error" {
+			err = errors.New(jsonData.ErrorMessage)
+		}
+	}
+	return
+}
+
+// Bookmarks of dataset in order they are listed by zfs_api
+func (z *zfsApiBackend) ListBookmarks(ctx context.Context, dataset string) (res []string, err error) {
 	var (
-		apiResponse []byte
-		param       map[string]string = make(map[string]string)
-		jsonData    jsonResponseGeneric
+		entities []ZfsEntity
+	)
+	if entities, err = z.ListAll(ctx); err == nil {
+		for _, entity := range entities {
+			if strings.HasPrefix(entity.Name, dataset+"#") {
+				res = append(res, entity.Name)
+			}
+		}
+	}
+	return
+}
+
+func (z *zfsApiBackend) DestroyBookmark(ctx context.Context, bookmark string) (err error) {
+	if !strings.Contains(bookmark, "#") {
+		return fmt.Errorf("%s is not a bookmark", bookmark)
+	}
+	return z.Destroy(ctx, bookmark)
+}
+
+func (z *zfsApiBackend) Rollback(ctx context.Context, snapshot string, recursive bool) (err error) {
+	var (
+		param    map[string]string = make(map[string]string)
+		jsonData jsonResponseGeneric
 	)
 	if snapshot != "" {
 		param["snapshot"] = snapshot
-		if apiResponse, err = apiCall(apiZfs, "rollback", param); err != nil {
-			log.Println(err.Error())
-		} else {
-			json.Unmarshal(apiResponse, &jsonData)
+		if recursive {
+			param["recursive"] = "1"
+		}
+		if err = z.client.Call(ctx, "rollback", param, false, &jsonData); err == nil {
 			if jsonData.Status == "error" {
 				err = errors.New(jsonData.ErrorMessage)
 			}
@@ -153,36 +239,90 @@ func ZfsRollback(apiZfs string, snapshot string) (err error) {
 	return
 }
 
-func ZfsDestroy(apiZfs string, dataset string) (err error) {
+func (z *zfsApiBackend) Destroy(ctx context.Context, dataset string) (err error) {
 	var (
-		apiResponse []byte
-		jsonData    jsonResponseGeneric
-		param       map[string]string = make(map[string]string)
+		jsonData jsonResponseGeneric
+		param    map[string]string = make(map[string]string)
 	)
 	param["dataset"] = dataset
-	if apiResponse, err = apiCall(apiZfs, "destroy", param); err != nil {
-		log.Println(err.Error())
-	} else {
-		json.Unmarshal(apiResponse, &jsonData)
+	if err = z.client.Call(ctx, "destroy", param, false, &jsonData); err == nil {
+		if jsonData.Status == "error" {
+			err = errors.New(jsonData.ErrorMessage)
+		}
+	}
+	return
+}
+
+// Destroy with options, names of removed datasets are taken from destroyed
+// list of zfs_api response
+func (z *zfsApiBackend) DestroyDataset(ctx context.Context, dataset string, opts ZfsDestroyOptions) (res []string, err error) {
+	var (
+		jsonData jsonResponseGeneric
+		param    map[string]string = make(map[string]string)
+	)
+	param["dataset"] = dataset
+	if opts.Recursive {
+		param["recursive"] = "1"
+	}
+	if opts.Deferred {
+		param["deferred"] = "1"
+	}
+	if err = z.client.Call(ctx, "destroy", param, false, &jsonData); err == nil {
 		if jsonData.Status == "error" {
 			err = errors.New(jsonData.ErrorMessage)
+		} else if destroyed, ok := jsonData.Data["destroyed"].([]interface{}); ok {
+			for _, name := range destroyed {
+				res = append(res, fmt.Sprintf("%v", name))
+			}
+		} else {
+			res = []string{dataset}
 		}
 	}
 	return
 }
 
-func ZfsCloneLast(apiZfs string, dataset string, origin string) (err error) {
+func (z *zfsApiBackend) GetClones(ctx context.Context, dataset string, recursive bool) (res []string, err error) {
 	var (
-		apiResponse []byte
-		jsonData    jsonResponseGeneric
-		param       map[string]string = make(map[string]string)
+		jsonData jsonResponseList
+		param    map[string]string = make(map[string]string)
+	)
+	param["dataset"] = dataset
+	if recursive {
+		param["recursive"] = "1"
+	}
+	if err = z.client.Call(ctx, "clones", param, true, &jsonData); err == nil {
+		if jsonData.Status == "error" {
+			err = errors.New(jsonData.ErrorMessage)
+		} else {
+			res = jsonData.Data
+		}
+	}
+	return
+}
+
+// Properties of new clone are passed as comma separated name=value list
+func cloneProperties(param map[string]string, props map[string]string) {
+	var (
+		list []string
+	)
+	for name, value := range props {
+		list = append(list, name+"="+value)
+	}
+	if len(list) > 0 {
+		sort.Strings(list)
+		param["properties"] = strings.Join(list, ",")
+	}
+}
+
+func (z *zfsApiBackend) CloneLast(ctx context.Context, dataset string, origin string, props map[string]string) (err error) {
+	var (
+		jsonData jsonResponseGeneric
+		param    map[string]string = make(map[string]string)
 	)
 	param["dataset"] = dataset
 	param["origin"] = origin
-	if apiResponse, err = apiCall(apiZfs, "clonelast", param); err != nil {
-		log.Println(err.Error())
-	} else {
-		json.Unmarshal(apiResponse, &jsonData)
+	cloneProperties(param, props)
+	if err = z.client.Call(ctx, "clonelast", param, false, &jsonData); err == nil {
 		if jsonData.Status == "error" {
 			err = errors.New(jsonData.ErrorMessage)
 		}
@@ -190,17 +330,29 @@ func ZfsCloneLast(apiZfs string, dataset string, origin string) (err error) {
 	return
 }
 
-func ZfsCheckDatasetExists(apiZfs string, dataset string) (res bool, err error) {
+func (z *zfsApiBackend) Clone(ctx context.Context, snapshot string, dataset string, props map[string]string) (err error) {
 	var (
-		apiResponse []byte
-		jsonData    jsonResponseGeneric
-		param       map[string]string = make(map[string]string)
+		jsonData jsonResponseGeneric
+		param    map[string]string = make(map[string]string)
 	)
+	param["snapshot"] = snapshot
 	param["dataset"] = dataset
-	if apiResponse, err = apiCall(apiZfs, "checkds", param); err != nil {
-		log.Println(err.Error())
-	} else {
-		json.Unmarshal(apiResponse, &jsonData)
+	cloneProperties(param, props)
+	if err = z.client.Call(ctx, "clone", param, false, &jsonData); err == nil {
+		if jsonData.Status == "error" {
+			err = errors.New(jsonData.ErrorMessage)
+		}
+	}
+	return
+}
+
+func (z *zfsApiBackend) CheckDatasetExists(ctx context.Context, dataset string) (res bool, err error) {
+	var (
+		jsonData jsonResponseGeneric
+		param    map[string]string = make(map[string]string)
+	)
+	param["dataset"] = dataset
+	if err = z.client.Call(ctx, "checkds", param, true, &jsonData); err == nil {
 		if jsonData.Status == "error" {
 			err = errors.New(jsonData.ErrorMessage)
 		} else {
@@ -211,3 +363,44 @@ func ZfsCheckDatasetExists(apiZfs string, dataset string) (res bool, err error)
 	}
 	return
 }
+
+// Send stream can not be passed through zfs_api
+func (z *zfsApiBackend) Send(ctx context.Context, opts ZfsSendOptions, w io.Writer) error {
+	return errors.New("send is not supported by api backend")
+}
+
+func (z *zfsApiBackend) SendSize(ctx context.Context, opts ZfsSendOptions) (int64, error) {
+	return 0, errors.New("send is not supported by api backend")
+}
+
+func (z *zfsApiBackend) Receive(ctx context.Context, dataset string, resumable bool, r io.Reader) error {
+	return errors.New("receive is not supported by api backend")
+}
+
+// Diff lines are returned by zfs_api as they are printed by zfs diff -H,
+// all of them at once
+func (z *zfsApiBackend) Diff(ctx context.Context, from string, to string, offset int, limit int) (res []XmlDiffEntry, more bool, err error) {
+	var (
+		param    map[string]string = make(map[string]string)
+		jsonData jsonResponseList
+		lines    []string
+		entry    XmlDiffEntry
+	)
+	param["from"] = from
+	param["to"] = to
+	if err = z.client.Call(ctx, "diff", param, true, &jsonData); err == nil {
+		if jsonData.Status == "error" {
+			err = errors.New(jsonData.ErrorMessage)
+		} else {
+			lines, more = diffPage(jsonData.Data, offset, limit)
+			res = make([]XmlDiffEntry, 0, len(lines))
+			for _, line := range lines {
+				if entry, err = parseDiffLine(strings.Split(line, "\t")); err != nil {
+					return nil, false, err
+				}
+				res = append(res, entry)
+			}
+		}
+	}
+	return
+}
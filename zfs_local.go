@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ZFS backend running zfs binary on the storage node itself
+type zfsLocalBackend struct {
+	binary string
+}
+
+func (z *zfsLocalBackend) run(ctx context.Context, args ...string) (res []byte, err error) {
+	var (
+		stderr bytes.Buffer
+	)
+	cmd := exec.CommandContext(ctx, z.binary, args...)
+	cmd.Stderr = &stderr
+	if res, err = cmd.Output(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = errors.New(msg)
+		}
+		log.Println(err.Error())
+	}
+	return
+}
+
+// Run zfs command with stream on its input or output
+func (z *zfsLocalBackend) stream(ctx context.Context, r io.Reader, w io.Writer, args ...string) (err error) {
+	var (
+		stderr bytes.Buffer
+	)
+	cmd := exec.CommandContext(ctx, z.binary, args...)
+	cmd.Stdin = r
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = errors.New(msg)
+		}
+		log.Println(err.Error())
+	}
+	return
+}
+
+// Run zfs command with scripted (-H) output and split it to lines and fields
+func (z *zfsLocalBackend) list(ctx context.Context, args ...string) (res [][]string, err error) {
+	var (
+		output []byte
+	)
+	if output, err = z.run(ctx, args...); err == nil {
+		for _, line := range strings.Split(strings.TrimRight(string(output), "\n"), "\n") {
+			if line != "" {
+				res = append(res, strings.Split(line, "\t"))
+			}
+		}
+	}
+	return
+}
+
+func (z *zfsLocalBackend) ListAll(ctx context.Context) (res []ZfsEntity, err error) {
+	var (
+		lines [][]string
+	)
+	if lines, err = z.list(ctx, "list", "-Hp", "-t", "all", "-o", "name,used,avail,refer,mountpoint"); err == nil {
+		for _, fields := range lines {
+			if len(fields) != 5 {
+				err = fmt.Errorf("unexpected zfs list output: %s", strings.Join(fields, " "))
+				break
+			}
+			res = append(res, ZfsEntity{
+				Name:       fields[0],
+				Used:       fields[1],
+				Avail:      fields[2],
+				Refer:      fields[3],
+				MountPoint: fields[4],
+			})
+		}
+	}
+	return
+}
+
+func (z *zfsLocalBackend) GetLastSnapshot(ctx context.Context, dataset string) (res string, err error) {
+	var (
+		snapshots []string
+	)
+	if snapshots, err = z.ListSnapshots(ctx, dataset); err == nil {
+		if len(snapshots) > 0 {
+			res = snapshots[len(snapshots)-1]
+		}
+	}
+	return
+}
+
+// Snapshots of dataset ordered by creation, oldest first
+func (z *zfsLocalBackend) ListSnapshots(ctx context.Context, dataset string) (res []string, err error) {
+	var (
+		lines [][]string
+	)
+	if lines, err = z.list(ctx, "list", "-Hp", "-t", "snapshot", "-o", "name", "-s", "createtxg", "-d", "1", dataset); err == nil {
+		for _, fields := range lines {
+			res = append(res, fields[0])
+		}
+	}
+	return
+}
+
+func (z *zfsLocalBackend) GetCloneInfo(ctx context.Context, dataset string) (map[string]string, error) {
+	return z.GetProperties(ctx, dataset, []string{"origin", "written"})
+}
+
+// Parsable values of properties, i.e. sizes in bytes and times in seconds.
+// Unset values are empty
+func (z *zfsLocalBackend) GetProperties(ctx context.Context, dataset string, props []string) (res map[string]string, err error) {
+	var (
+		lines [][]string
+	)
+	if lines, err = z.list(ctx, "get", "-Hp", "-o", "property,value", strings.Join(props, ","), dataset); err == nil {
+		res = make(map[string]string)
+		for _, fields := range lines {
+			if len(fields) != 2 {
+				err = fmt.Errorf("unexpected zfs get output: %s", strings.Join(fields, " "))
+				break
+			}
+			if fields[1] == "-" {
+				fields[1] = ""
+			}
+			res[fields[0]] = fields[1]
+		}
+	}
+	return
+}
+
+func (z *zfsLocalBackend) CreateSnapshot(ctx context.Context, snapsource string, snapname string) (err error) {
+	_, err = z.run(ctx, "snapshot", snapsource+"@"+snapname)
+	return
+}
+
+func (z *zfsLocalBackend) CreateBookmark(ctx context.Context, snapshot string, bookmark string) (err error) {
+	_, err = z.run(ctx, "bookmark", snapshot, bookmark)
+	return
+}
+
+// Bookmarks of dataset ordered by creation, oldest first
+func (z *zfsLocalBackend) ListBookmarks(ctx context.Context, dataset string) (res []string, err error) {
+	var (
+		lines [][]string
+	)
+	if lines, err = z.list(ctx, "list", "-Hp", "-t", "bookmark", "-o", "name", "-s", "createtxg", "-d", "1", dataset); err == nil {
+		for _, fields := range lines {
+			res = append(res, fields[0])
+		}
+	}
+	return
+}
+
+func (z *zfsLocalBackend) DestroyBookmark(ctx context.Context, bookmark string) (err error) {
+	if !strings.Contains(bookmark, "#") {
+		return fmt.Errorf("%s is not a bookmark", bookmark)
+	}
+	_, err = z.run(ctx, "destroy", bookmark)
+	return
+}
+
+func (z *zfsLocalBackend) Rollback(ctx context.Context, snapshot string, recursive bool) (err error) {
+	if snapshot == "" {
+		err = errors.New("missing snapshot name")
+	} else if recursive {
+		_, err = z.run(ctx, "rollback", "-r", snapshot)
+	} else {
+		_, err = z.run(ctx, "rollback", snapshot)
+	}
+	return
+}
+
+// Dataset is destroyed together with its snapshots, smartClone relies on it
+func (z *zfsLocalBackend) Destroy(ctx context.Context, dataset string) (err error) {
+	_, err = z.run(ctx, "destroy", "-r", dataset)
+	return
+}
+
+// Names of removed datasets are collected with dry run before destroying
+func (z *zfsLocalBackend) DestroyDataset(ctx context.Context, dataset string, opts ZfsDestroyOptions) (res []string, err error) {
+	var (
+		lines [][]string
+		flags []string
+	)
+	if opts.Recursive {
+		flags = append(flags, "-r")
+	}
+	if opts.Deferred {
+		flags = append(flags, "-d")
+	}
+	args := append(append([]string{"destroy", "-nvp"}, flags...), dataset)
+	if lines, err = z.list(ctx, args...); err != nil {
+		return
+	}
+	for _, fields := range lines {
+		if len(fields) == 2 && fields[0] == "destroy" {
+			res = append(res, fields[1])
+		}
+	}
+	args = append(append([]string{"destroy"}, flags...), dataset)
+	if _, err = z.run(ctx, args...); err != nil {
+		res = nil
+	}
+	return
+}
+
+// Clones depending on snapshots of dataset or on snapshot itself
+func (z *zfsLocalBackend) GetClones(ctx context.Context, dataset string, recursive bool) (res []string, err error) {
+	var (
+		lines [][]string
+	)
+	depth := []string{"-d", "1"}
+	if recursive {
+		depth = []string{"-r"}
+	}
+	args := append(append([]string{"get", "-Hp", "-o", "name,value", "-t", "snapshot"}, depth...), "clones", dataset)
+	if lines, err = z.list(ctx, args...); err == nil {
+		for _, fields := range lines {
+			if len(fields) != 2 {
+				err = fmt.Errorf("unexpected zfs get output: %s", strings.Join(fields, " "))
+				break
+			}
+			if fields[1] != "" && fields[1] != "-" {
+				res = append(res, strings.Split(fields[1], ",")...)
+			}
+		}
+	}
+	return
+}
+
+func (z *zfsLocalBackend) Clone(ctx context.Context, snapshot string, dataset string, props map[string]string) (err error) {
+	var (
+		names []string
+	)
+	args := []string{"clone"}
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, "-o", name+"="+props[name])
+	}
+	_, err = z.run(ctx, append(args, snapshot, dataset)...)
+	return
+}
+
+func (z *zfsLocalBackend) CloneLast(ctx context.Context, dataset string, origin string, props map[string]string) (err error) {
+	var (
+		lastSnapshot string
+	)
+	if lastSnapshot, err = z.GetLastSnapshot(ctx, origin); err == nil {
+		if lastSnapshot == "" {
+			err = fmt.Errorf("there is no any snapshot in %s", origin)
+		} else {
+			err = z.Clone(ctx, lastSnapshot, dataset, props)
+		}
+	}
+	return
+}
+
+func (z *zfsLocalBackend) CheckDatasetExists(ctx context.Context, dataset string) (res bool, err error) {
+	if _, err = z.run(ctx, "list", "-H", "-o", "name", "-t", "all", dataset); err != nil {
+		if strings.Contains(err.Error(), "does not exist") {
+			err = nil
+		}
+	} else {
+		res = true
+	}
+	return
+}
+
+// Arguments of zfs send after send command itself
+func sendArgs(opts ZfsSendOptions) (args []string, err error) {
+	// Resume token carries flags of interrupted stream
+	if opts.ResumeToken != "" {
+		return []string{"-t", opts.ResumeToken}, nil
+	}
+	if opts.Compressed {
+		args = append(args, "-c")
+	}
+	if opts.Raw {
+		args = append(args, "-w")
+	}
+	switch {
+	case opts.Snapshot == "":
+		err = errors.New("missing snapshot name")
+	case opts.From != "" && opts.Intermediate:
+		args = append(args, "-I", opts.From, opts.Snapshot)
+	case opts.From != "":
+		args = append(args, "-i", opts.From, opts.Snapshot)
+	default:
+		args = append(args, opts.Snapshot)
+	}
+	return
+}
+
+func (z *zfsLocalBackend) Send(ctx context.Context, opts ZfsSendOptions, w io.Writer) (err error) {
+	var (
+		args []string
+	)
+	if args, err = sendArgs(opts); err == nil {
+		err = z.stream(ctx, nil, w, append([]string{"send"}, args...)...)
+	}
+	return
+}
+
+// Estimated size of send stream in bytes, taken from dry run
+func (z *zfsLocalBackend) SendSize(ctx context.Context, opts ZfsSendOptions) (res int64, err error) {
+	var (
+		args  []string
+		lines [][]string
+	)
+	if args, err = sendArgs(opts); err != nil {
+		return
+	}
+	if lines, err = z.list(ctx, append([]string{"send", "-nP"}, args...)...); err == nil {
+		for _, fields := range lines {
+			if len(fields) == 2 && fields[0] == "size" {
+				res, err = strconv.ParseInt(fields[1], 10, 64)
+			}
+		}
+	}
+	return
+}
+
+// Receive stream into dataset. Resumable receive keeps partially received
+// state so interrupted stream can be continued with receive_resume_token
+func (z *zfsLocalBackend) Receive(ctx context.Context, dataset string, resumable bool, r io.Reader) (err error) {
+	if resumable {
+		return z.stream(ctx, r, nil, "receive", "-s", dataset)
+	}
+	return z.stream(ctx, r, nil, "receive", dataset)
+}
+
+// Changes between snapshot and later snapshot or dataset. Without to
+// snapshot is compared with current state of its dataset
+// Output of zfs diff is read only up to the requested page, zfs is killed
+// once the page is filled and one more line shows there are more changes
+func (z *zfsLocalBackend) Diff(ctx context.Context, from string, to string, offset int, limit int) (res []XmlDiffEntry, more bool, err error) {
+	var (
+		stderr bytes.Buffer
+		stdout io.ReadCloser
+		entry  XmlDiffEntry
+		n      int
+	)
+	args := []string{"diff", "-H", from}
+	if to != "" {
+		args = append(args, to)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, z.binary, args...)
+	cmd.Stderr = &stderr
+	if stdout, err = cmd.StdoutPipe(); err != nil {
+		return
+	}
+	if err = cmd.Start(); err != nil {
+		log.Println(err.Error())
+		return
+	}
+	res = []XmlDiffEntry{}
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if scanner.Text() == "" {
+			continue
+		}
+		if n >= offset+limit {
+			more = true
+			break
+		}
+		if n >= offset {
+			if entry, err = parseDiffLine(strings.Split(scanner.Text(), "\t")); err != nil {
+				break
+			}
+			res = append(res, entry)
+		}
+		n++
+	}
+	if err == nil && !more {
+		err = scanner.Err()
+	}
+	if err != nil || more {
+		// The rest of output is not needed
+		cancel()
+		cmd.Wait()
+		if err != nil {
+			return nil, false, err
+		}
+		return
+	}
+	if err = cmd.Wait(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = errors.New(msg)
+		}
+		log.Println(err.Error())
+		return nil, false, err
+	}
+	return
+}
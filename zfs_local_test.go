@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Reply of fake zfs binary
+type fakeZfsReply struct {
+	stdout string
+	stderr string
+	code   int
+}
+
+// Local backend running fake zfs script which prints reply and appends its
+// arguments to the returned calls file, one call per line
+func fakeZfs(t *testing.T, reply fakeZfsReply) (*zfsLocalBackend, string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range map[string]string{"stdout": reply.stdout, "stderr": reply.stderr} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	script := "#!/bin/sh\n" +
+		"echo \"$@\" >> '" + dir + "/calls'\n" +
+		"cat '" + dir + "/stdout'\n" +
+		"cat '" + dir + "/stderr' >&2\n" +
+		"exit " + strconv.Itoa(reply.code) + "\n"
+	binary := filepath.Join(dir, "zfs")
+	if err := ioutil.WriteFile(binary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return &zfsLocalBackend{binary: binary}, filepath.Join(dir, "calls")
+}
+
+func fakeZfsCalls(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+}
+
+func TestLocalListAll(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   fakeZfsReply
+		want    []ZfsEntity
+		wantErr bool
+	}{
+		{
+			name: "datasets and snapshots",
+			reply: fakeZfsReply{stdout: "data\t1024\t4096\t512\t/data\n" +
+				"data/kvm/desktop/1@0\t0\t-\t8192\t-\n"},
+			want: []ZfsEntity{
+				{Name: "data", Used: "1024", Avail: "4096", Refer: "512", MountPoint: "/data"},
+				{Name: "data/kvm/desktop/1@0", Used: "0", Avail: "-", Refer: "8192", MountPoint: "-"},
+			},
+		},
+		{
+			name:  "nothing",
+			reply: fakeZfsReply{},
+		},
+		{
+			name:    "missing field",
+			reply:   fakeZfsReply{stdout: "data\t1024\t4096\t512\n"},
+			wantErr: true,
+		},
+		{
+			name:    "zfs error",
+			reply:   fakeZfsReply{stderr: "internal error", code: 1},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z, calls := fakeZfs(t, tt.reply)
+			got, err := z.ListAll(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			want := "list -Hp -t all -o name,used,avail,refer,mountpoint"
+			if got := fakeZfsCalls(t, calls); got[0] != want {
+				t.Errorf("called %q, want %q", got[0], want)
+			}
+		})
+	}
+}
+
+func TestLocalGetProperties(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   fakeZfsReply
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:  "clone",
+			reply: fakeZfsReply{stdout: "origin\tdata/master@s1\nwritten\t1048576\n"},
+			want:  map[string]string{"origin": "data/master@s1", "written": "1048576"},
+		},
+		{
+			name:  "unset values are empty",
+			reply: fakeZfsReply{stdout: "origin\t-\nwritten\t0\n"},
+			want:  map[string]string{"origin": "", "written": "0"},
+		},
+		{
+			name:    "unexpected output",
+			reply:   fakeZfsReply{stdout: "origin\n"},
+			wantErr: true,
+		},
+		{
+			name:    "missing dataset",
+			reply:   fakeZfsReply{stderr: "cannot open 'data/x': dataset does not exist", code: 1},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z, calls := fakeZfs(t, tt.reply)
+			got, err := z.GetProperties(context.Background(), "data/x", []string{"origin", "written"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			want := "get -Hp -o property,value origin,written data/x"
+			if got := fakeZfsCalls(t, calls); got[0] != want {
+				t.Errorf("called %q, want %q", got[0], want)
+			}
+		})
+	}
+}
+
+func TestLocalDestroyDataset(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      ZfsDestroyOptions
+		reply     fakeZfsReply
+		want      []string
+		wantCalls []string
+		wantErr   bool
+	}{
+		{
+			name:      "dataset",
+			reply:     fakeZfsReply{stdout: "destroy\tdata/a\nreclaim\t4096\n"},
+			want:      []string{"data/a"},
+			wantCalls: []string{"destroy -nvp data/a", "destroy data/a"},
+		},
+		{
+			name:      "recursive",
+			opts:      ZfsDestroyOptions{Recursive: true},
+			reply:     fakeZfsReply{stdout: "destroy\tdata/a@0\ndestroy\tdata/a/b\ndestroy\tdata/a\nreclaim\t8192\n"},
+			want:      []string{"data/a@0", "data/a/b", "data/a"},
+			wantCalls: []string{"destroy -nvp -r data/a", "destroy -r data/a"},
+		},
+		{
+			name:      "deferred",
+			opts:      ZfsDestroyOptions{Deferred: true},
+			reply:     fakeZfsReply{stdout: "destroy\tdata/a\n"},
+			want:      []string{"data/a"},
+			wantCalls: []string{"destroy -nvp -d data/a", "destroy -d data/a"},
+		},
+		{
+			name:      "dry run fails",
+			reply:     fakeZfsReply{stderr: "cannot destroy 'data/a': filesystem has children", code: 1},
+			wantCalls: []string{"destroy -nvp data/a"},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z, calls := fakeZfs(t, tt.reply)
+			got, err := z.DestroyDataset(context.Background(), "data/a", tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if got := fakeZfsCalls(t, calls); !reflect.DeepEqual(got, tt.wantCalls) {
+				t.Errorf("called %q, want %q", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestLocalSendSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     ZfsSendOptions
+		reply    fakeZfsReply
+		want     int64
+		wantCall string
+		wantErr  bool
+	}{
+		{
+			name:     "full",
+			opts:     ZfsSendOptions{Snapshot: "data/a@1"},
+			reply:    fakeZfsReply{stdout: "full\tdata/a@1\t123456\nsize\t123456\n"},
+			want:     123456,
+			wantCall: "send -nP data/a@1",
+		},
+		{
+			name:     "intermediate",
+			opts:     ZfsSendOptions{Snapshot: "data/a@3", From: "data/a@1", Intermediate: true},
+			reply:    fakeZfsReply{stdout: "incremental\t1\tdata/a@2\t100\nincremental\t2\tdata/a@3\t200\nsize\t300\n"},
+			want:     300,
+			wantCall: "send -nP -I data/a@1 data/a@3",
+		},
+		{
+			name:     "resume token",
+			opts:     ZfsSendOptions{ResumeToken: "1-tok"},
+			reply:    fakeZfsReply{stdout: "resume token contents:\nsize\t42\n"},
+			want:     42,
+			wantCall: "send -nP -t 1-tok",
+		},
+		{
+			name:     "no size",
+			opts:     ZfsSendOptions{Snapshot: "data/a@1"},
+			reply:    fakeZfsReply{stdout: "full\tdata/a@1\n"},
+			wantCall: "send -nP data/a@1",
+		},
+		{
+			name:     "invalid size",
+			opts:     ZfsSendOptions{Snapshot: "data/a@1"},
+			reply:    fakeZfsReply{stdout: "size\tlots\n"},
+			wantCall: "send -nP data/a@1",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z, calls := fakeZfs(t, tt.reply)
+			got, err := z.SendSize(context.Background(), tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+			if got := fakeZfsCalls(t, calls); got[0] != tt.wantCall {
+				t.Errorf("called %q, want %q", got[0], tt.wantCall)
+			}
+		})
+	}
+}
+
+func TestLocalGetClones(t *testing.T) {
+	tests := []struct {
+		name      string
+		recursive bool
+		reply     fakeZfsReply
+		want      []string
+		wantCall  string
+		wantErr   bool
+	}{
+		{
+			name:     "clones of snapshots",
+			reply:    fakeZfsReply{stdout: "data/m@s1\tdata/c1,data/c2\ndata/m@s2\t\ndata/m@s3\t-\n"},
+			want:     []string{"data/c1", "data/c2"},
+			wantCall: "get -Hp -o name,value -t snapshot -d 1 clones data/m",
+		},
+		{
+			name:      "recursive",
+			recursive: true,
+			reply:     fakeZfsReply{stdout: "data/m/child@0\tdata/c3\n"},
+			want:      []string{"data/c3"},
+			wantCall:  "get -Hp -o name,value -t snapshot -r clones data/m",
+		},
+		{
+			name:     "no snapshots",
+			reply:    fakeZfsReply{},
+			wantCall: "get -Hp -o name,value -t snapshot -d 1 clones data/m",
+		},
+		{
+			name:     "unexpected output",
+			reply:    fakeZfsReply{stdout: "data/m@s1\n"},
+			wantCall: "get -Hp -o name,value -t snapshot -d 1 clones data/m",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z, calls := fakeZfs(t, tt.reply)
+			got, err := z.GetClones(context.Background(), "data/m", tt.recursive)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if got := fakeZfsCalls(t, calls); got[0] != tt.wantCall {
+				t.Errorf("called %q, want %q", got[0], tt.wantCall)
+			}
+		})
+	}
+}
+
+func TestLocalDiff(t *testing.T) {
+	output := "M\t/home/\n+\t/home/a\n-\t/home/b\nR\t/home/c\t/home/d\n"
+	tests := []struct {
+		name     string
+		reply    fakeZfsReply
+		offset   int
+		limit    int
+		want     []XmlDiffEntry
+		wantMore bool
+		wantErr  bool
+	}{
+		{
+			name:  "all",
+			reply: fakeZfsReply{stdout: output},
+			limit: 10,
+			want: []XmlDiffEntry{
+				{Type: "modified", Path: "/home/"},
+				{Type: "added", Path: "/home/a"},
+				{Type: "removed", Path: "/home/b"},
+				{Type: "renamed", Path: "/home/c", NewPath: "/home/d"},
+			},
+		},
+		{
+			name:     "first page",
+			reply:    fakeZfsReply{stdout: output},
+			limit:    2,
+			want:     []XmlDiffEntry{{Type: "modified", Path: "/home/"}, {Type: "added", Path: "/home/a"}},
+			wantMore: true,
+		},
+		{
+			name:   "last page",
+			reply:  fakeZfsReply{stdout: output},
+			offset: 2,
+			limit:  2,
+			want:   []XmlDiffEntry{{Type: "removed", Path: "/home/b"}, {Type: "renamed", Path: "/home/c", NewPath: "/home/d"}},
+		},
+		{
+			name:   "after the end",
+			reply:  fakeZfsReply{stdout: output},
+			offset: 10,
+			limit:  2,
+			want:   []XmlDiffEntry{},
+		},
+		{
+			name:    "unknown change",
+			reply:   fakeZfsReply{stdout: "X\t/home/a\n"},
+			limit:   10,
+			wantErr: true,
+		},
+		{
+			name:    "zfs error",
+			reply:   fakeZfsReply{stderr: "Unable to obtain diffs", code: 1},
+			limit:   10,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z, calls := fakeZfs(t, tt.reply)
+			got, more, err := z.Diff(context.Background(), "data/fs@0", "data/fs", tt.offset, tt.limit)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (!reflect.DeepEqual(got, tt.want) || more != tt.wantMore) {
+				t.Errorf("got %v, more %v, want %v, more %v", got, more, tt.want, tt.wantMore)
+			}
+			if got, want := fakeZfsCalls(t, calls)[0], "diff -H data/fs@0 data/fs"; got != want {
+				t.Errorf("called %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestLocalCheckDatasetExists(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   fakeZfsReply
+		want    bool
+		wantErr bool
+	}{
+		{
+			name:  "exists",
+			reply: fakeZfsReply{stdout: "data/a\n"},
+			want:  true,
+		},
+		{
+			name:  "does not exist",
+			reply: fakeZfsReply{stderr: "cannot open 'data/a': dataset does not exist", code: 1},
+		},
+		{
+			name:    "zfs error",
+			reply:   fakeZfsReply{stderr: "permission denied", code: 1},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z, _ := fakeZfs(t, tt.reply)
+			got, err := z.CheckDatasetExists(context.Background(), "data/a")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewZfsBackendLooksUpPath(t *testing.T) {
+	z, _ := fakeZfs(t, fakeZfsReply{})
+	t.Setenv("PATH", filepath.Dir(z.binary)+string(os.PathListSeparator)+os.Getenv("PATH"))
+	cfg := &Config{}
+	cfg.Zfs.Backend = "local"
+	backend, err := NewZfsBackend(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := backend.(*zfsLocalBackend).binary; got != z.binary {
+		t.Errorf("binary = %s, want %s", got, z.binary)
+	}
+}